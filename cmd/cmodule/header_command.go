@@ -9,14 +9,14 @@ import (
 	"flag"
 	"io"
 	"os"
-	"text/template"
-	"time"
 
 	"github.com/jlubawy/go-cli"
 	"github.com/jlubawy/go-ctlog/cmodule"
+	"github.com/jlubawy/go-ctlog/project"
 )
 
 type HeaderOptions struct {
+	Config string
 	Output string
 }
 
@@ -25,36 +25,58 @@ var headerOptions HeaderOptions
 var headerCommand = cli.Command{
 	Name:             "header",
 	ShortDescription: "create a C header file from the provided cmodules JSON",
-	Description:      "Create a C header file from the provided cmodules JSON.",
-	ShortUsage:       "[-output output] [cmodule JSON]",
+	Description:      "Create a C header file from the provided cmodules JSON, or the project's modules JSON if none is provided.",
+	ShortUsage:       "[-config config] [-output output] [cmodule JSON]",
 	SetupFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&headerOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
 		fs.StringVar(&headerOptions.Output, "output", "", "output file or stdout if empty")
 	},
 	Run: func(args []string) {
-		if len(args) == 0 {
-			cli.Info("Must provide a module JSON file.\n")
+		cfg, err := project.Open(headerOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
+		}
+
+		var (
+			input  string
+			output = headerOptions.Output
+			opts   cmodule.HeaderOptions
+		)
+		if cfg != nil {
+			opts = cfg.Header
 		}
 
-		if len(args) != 1 {
-			cli.Info("Only accepts one module JSON file.\n")
+		switch len(args) {
+		case 0:
+			if cfg == nil || cfg.Output.Modules == "" {
+				cli.Fatal("Must provide a module JSON file.\n")
+			}
+			input = cfg.Path(cfg.Output.Modules)
+			if output == "" {
+				output = cfg.Path(cfg.Output.Header)
+			}
+		case 1:
+			input = args[0]
+		default:
+			cli.Fatal("Only accepts one module JSON file.\n")
 		}
 
-		f, err := os.Open(args[0])
+		f, err := os.Open(input)
 		if err != nil {
 			cli.Fatalf("Error opening modules JSON file: %v\n", err)
 		}
 		defer f.Close()
 
-		var info ModulesInfo
+		var info cmodule.Info
 		if err := json.NewDecoder(f).Decode(&info); err != nil {
 			cli.Fatalf("Error decoding JSON: %v\n", err)
 		}
 
 		var w io.Writer
-		if headerOptions.Output == "" {
+		if output == "" {
 			w = os.Stdout
 		} else {
-			f, err := os.OpenFile(headerOptions.Output, os.O_CREATE|os.O_WRONLY, 0664)
+			f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
 			if err != nil {
 				cli.Fatalf("Error opening output file: %v\n", err)
 			}
@@ -62,36 +84,8 @@ var headerCommand = cli.Command{
 			w = f
 		}
 
-		if err := templHeader.Execute(w, &info); err != nil {
+		if err := cmodule.WriteHeader(w, &info, &opts); err != nil {
 			cli.Fatalf("Error executing template: %v\n", err)
 		}
 	},
 }
-
-var templHeader = template.Must(template.New("").Parse(`/**
- * Auto-generated module index definitions for a given project.
- */
-
-// Generated on: {{.Date}}
-// Using search paths:
-{{range .SearchPaths}}{{printf "//   - %s" .}}
-{{end}}
-
-#ifndef CMODULE_INDICES_H
-#define CMODULE_INDICES_H
-
-/*==============================================================================
- *                                   Defines
- *============================================================================*/
-/*============================================================================*/
-{{range $moduleIdx, $module := .Modules}}#define CMODULE_INDEX_{{printf "%-32s" $module.Name}}  ({{$module.Index}})
-{{end}}
-
-#endif /* CMODULE_INDICES_H */
-`))
-
-type ModulesInfo struct {
-	Date        time.Time        `json:"date"`
-	SearchPaths []string         `json:"searchPaths"`
-	Modules     []cmodule.Module `json:"modules"`
-}
@@ -9,15 +9,20 @@ import (
 	"flag"
 	"io"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/jlubawy/go-cli"
 	"github.com/jlubawy/go-ctlog/cmodule"
+	"github.com/jlubawy/go-ctlog/project"
 )
 
 type JSONOptions struct {
-	Compact bool
-	Output  string
+	Compact      bool
+	Config       string
+	Extensions   string
+	Output       string
+	Reproducible bool
+	Root         string
 }
 
 var jsonOptions JSONOptions
@@ -25,43 +30,77 @@ var jsonOptions JSONOptions
 var jsonCommand = cli.Command{
 	Name:             "json",
 	ShortDescription: "walk C source directories and output JSON module info",
-	Description:      "Walk C source directories and output JSON module info.",
-	ShortUsage:       "[-output output] [directories...]",
+	Description:      "Walk C source directories, or the project's search roots if none are provided, and output JSON module info.",
+	ShortUsage:       "[-config config] [-extensions exts] [-output output] [-reproducible] [-root root] [directories...]",
 	SetupFlags: func(fs *flag.FlagSet) {
 		fs.BoolVar(&jsonOptions.Compact, "compact", false, "output compact JSON")
+		fs.StringVar(&jsonOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
+		fs.StringVar(&jsonOptions.Extensions, "extensions", "", "comma-separated list of file extensions to search or the defaults if empty")
 		fs.StringVar(&jsonOptions.Output, "output", "", "output file or stdout if empty")
+		fs.BoolVar(&jsonOptions.Reproducible, "reproducible", false, "output paths relative to the project root and a fixed date")
+		fs.StringVar(&jsonOptions.Root, "root", "", "project root that paths are relative to, or the project's directory if empty")
 	},
 	Run: func(args []string) {
+		cfg, err := project.Open(jsonOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
+		}
+
+		var (
+			walker cmodule.Walker
+			output = jsonOptions.Output
+		)
+		if cfg != nil {
+			walker = cfg.Walker()
+			if len(args) == 0 {
+				args = cfg.SearchPaths()
+				if output == "" {
+					output = cfg.Path(cfg.Output.Modules)
+				}
+			}
+		}
+		if jsonOptions.Extensions != "" {
+			walker.Extensions = strings.Split(jsonOptions.Extensions, ",")
+		}
+
+		reproducible := jsonOptions.Reproducible || (cfg != nil && cfg.Reproducible)
+		if jsonOptions.Root != "" {
+			walker.Root = jsonOptions.Root
+		} else if reproducible && walker.Root == "" {
+			walker.Root = projectDir(cfg)
+		}
+
 		if len(args) == 0 {
 			cli.Info("Must provide at least one directory.\n")
 			os.Exit(1)
 		}
 
-		modules, err := cmodule.WalkDirs(args...)
+		modules, err := walker.WalkDirs(args...)
 		if err != nil {
 			cli.Fatalf("Error walking directories: %v\n", err)
 		}
 
-		sps := make([]string, len(args))
-		for i := 0; i < len(sps); i++ {
-			cp, err := cmodule.PathAbsToSlash(args[i])
-			if err != nil {
-				cli.Fatalf("Error cleaning search path: %v\n", err)
-			}
-			sps[i] = cp
+		sps, err := walker.SearchPaths(args...)
+		if err != nil {
+			cli.Fatalf("Error cleaning search path: %v\n", err)
+		}
+
+		date, err := project.Date(reproducible)
+		if err != nil {
+			cli.Fatalf("Error getting date: %v\n", err)
 		}
 
-		info := ModulesInfo{
-			Date:        time.Now().UTC(),
+		info := cmodule.Info{
+			Date:        date,
 			SearchPaths: sps,
 			Modules:     modules,
 		}
 
 		var w io.Writer
-		if jsonOptions.Output == "" {
+		if output == "" {
 			w = os.Stdout
 		} else {
-			f, err := os.OpenFile(jsonOptions.Output, os.O_CREATE|os.O_WRONLY, 0664)
+			f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
 			if err != nil {
 				cli.Fatalf("Error opening output file: %v\n", err)
 			}
@@ -79,3 +118,12 @@ var jsonCommand = cli.Command{
 		}
 	},
 }
+
+// projectDir returns the directory containing the project configuration, or
+// the working directory if there isn't one.
+func projectDir(cfg *project.Config) string {
+	if cfg != nil {
+		return cfg.Dir
+	}
+	return "."
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctlog/cmodule"
+	"github.com/jlubawy/go-ctlog/ctlog"
+	"github.com/jlubawy/go-ctlog/project"
+)
+
+type BuildOptions struct {
+	BuildID         string
+	Cache           string
+	Compact         bool
+	Config          string
+	Dictionary      string
+	Header          string
+	Macros          macroSpecs
+	Modules         string
+	NoDefaultMacros bool
+	Reproducible    bool
+	Root            string
+}
+
+var buildOptions BuildOptions
+
+var buildCommand = cli.Command{
+	Name:             "build",
+	ShortDescription: "generate the module indices header, modules JSON and dictionary in one pass",
+	Description: "Build walks the C source directories, or the project's search roots if none are provided, " +
+		"and generates the module indices header, modules JSON and dictionary in a single pass. " +
+		"Files are only rewritten if their contents changed.",
+	ShortUsage: "[-cache cache] [-config config] [-header header] [-modules modules] [-dict dictionary] [-build-id header] [-reproducible] [-root root] [directories...]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&buildOptions.BuildID, "build-id", "", "build ID header output file or the project's if empty")
+		fs.StringVar(&buildOptions.Cache, "cache", "", "cache file used to skip unchanged source files or the project's if empty")
+		fs.BoolVar(&buildOptions.Compact, "compact", false, "output compact JSON")
+		fs.StringVar(&buildOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
+		fs.StringVar(&buildOptions.Dictionary, "dict", "", "dictionary output file or the project's if empty")
+		fs.StringVar(&buildOptions.Header, "header", "", "module indices header output file or the project's if empty")
+		fs.Var(&buildOptions.Macros, "macro", "additional logging macro spec NAME:FORMAT:COUNT:LEVEL, may be repeated")
+		fs.StringVar(&buildOptions.Modules, "modules", "", "modules JSON output file or the project's if empty")
+		fs.BoolVar(&buildOptions.NoDefaultMacros, "no-default-macros", false, "don't search for the default CTLOG_* macros")
+		fs.BoolVar(&buildOptions.Reproducible, "reproducible", false, "output paths relative to the project root and a fixed date")
+		fs.StringVar(&buildOptions.Root, "root", "", "project root that paths are relative to, or the project's directory if empty")
+	},
+	Run: func(args []string) {
+		cfg, err := project.Open(buildOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
+		}
+
+		var (
+			walker     cmodule.Walker
+			headerOpts cmodule.HeaderOptions
+			outHeader  = buildOptions.Header
+			outModules = buildOptions.Modules
+			outDict    = buildOptions.Dictionary
+			outBuildID = buildOptions.BuildID
+		)
+		if cfg != nil {
+			walker = cfg.Walker()
+			headerOpts = cfg.Header
+			if len(args) == 0 {
+				args = cfg.SearchPaths()
+			}
+			if outHeader == "" {
+				outHeader = cfg.Path(cfg.Output.Header)
+			}
+			if outModules == "" {
+				outModules = cfg.Path(cfg.Output.Modules)
+			}
+			if outDict == "" {
+				outDict = cfg.Path(cfg.Output.Dictionary)
+			}
+			if outBuildID == "" {
+				outBuildID = cfg.Path(cfg.Output.BuildID)
+			}
+		}
+
+		if len(args) == 0 {
+			cli.Fatal("Must provide at least one directory.\n")
+		}
+		if outHeader == "" && outModules == "" && outDict == "" && outBuildID == "" {
+			cli.Fatal("Must provide at least one output file.\n")
+		}
+
+		reproducible := buildOptions.Reproducible || (cfg != nil && cfg.Reproducible)
+		if buildOptions.Root != "" {
+			walker.Root = buildOptions.Root
+		} else if reproducible && walker.Root == "" {
+			walker.Root = projectDir(cfg)
+		}
+
+		x := newExtractor(cfg, buildOptions.NoDefaultMacros, buildOptions.Macros)
+
+		// Keep the contents of each module as it's walked so each file is
+		// only read once
+		visited := make(map[string]ctlog.SourceFile)
+		walker.Visit = func(module cmodule.Module, info os.FileInfo, data []byte) error {
+			visited[module.Path] = ctlog.SourceFile{Info: info, Data: data}
+			return nil
+		}
+
+		modules, err := walker.WalkDirs(args...)
+		if err != nil {
+			cli.Fatalf("Error walking directories: %v\n", err)
+		}
+
+		sps, err := walker.SearchPaths(args...)
+		if err != nil {
+			cli.Fatalf("Error cleaning search path: %v\n", err)
+		}
+
+		cachePath := buildOptions.Cache
+		if cachePath == "" && cfg != nil {
+			cachePath = cfg.Path(cfg.Cache)
+		}
+		cache := loadCache(cachePath)
+
+		root := walker.Root
+		if root == "" {
+			root = "."
+		}
+		dictModules := findModules(x, modules, visited, root, cache)
+
+		date, err := project.Date(reproducible)
+		if err != nil {
+			cli.Fatalf("Error getting date: %v\n", err)
+		}
+		info := cmodule.Info{
+			Date:        date,
+			SearchPaths: sps,
+			Modules:     modules,
+		}
+		dict := ctlog.Dictionary{
+			Date:    date,
+			Modules: dictModules,
+		}
+		if cfg != nil {
+			dict.LineConvention = cfg.LineConvention
+		}
+		dict.BuildID = dict.Fingerprint()
+		warnCollisions(&dict)
+
+		// Keep the previous dates if nothing else changed, otherwise every
+		// build would rewrite every file
+		if !reproducible {
+			var prevInfo cmodule.Info
+			if readJSON(outModules, &prevInfo) && reflect.DeepEqual(prevInfo.SearchPaths, info.SearchPaths) && reflect.DeepEqual(prevInfo.Modules, info.Modules) {
+				info.Date = prevInfo.Date
+			}
+			var prevDict ctlog.Dictionary
+			if readJSON(outDict, &prevDict) && reflect.DeepEqual(prevDict.Modules, dict.Modules) {
+				dict.Date = prevDict.Date
+			}
+		}
+
+		header := writeHeader(&info, &headerOpts)
+		if !reproducible && outHeader != "" {
+			// The header records the date too, keep its previous date if
+			// nothing else changed even if the modules JSON isn't written
+			if prev, err := ioutil.ReadFile(outHeader); err == nil && !bytes.Equal(prev, header) {
+				if prevDate, ok := cmodule.HeaderDate(prev); ok {
+					prevInfo := info
+					prevInfo.Date = prevDate
+					if prevHeader := writeHeader(&prevInfo, &headerOpts); bytes.Equal(prev, prevHeader) {
+						info = prevInfo
+						header = prevHeader
+					}
+				}
+			}
+		}
+
+		// Write every file together so a failure doesn't leave a header and
+		// dictionary that don't match
+		var files []project.File
+		for _, file := range []project.File{
+			{Path: outHeader, Data: header},
+			{Path: outModules, Data: encodeJSON(&info, buildOptions.Compact)},
+			{Path: outDict, Data: encodeJSON(&dict, buildOptions.Compact)},
+			{Path: outBuildID, Data: buildIDHeader(dict.BuildID)},
+		} {
+			if file.Path != "" {
+				file.Perm = 0664
+				files = append(files, file)
+			}
+		}
+		if _, err := project.WriteFiles(files); err != nil {
+			cli.Fatalf("Error writing output files: %v\n", err)
+		}
+		saveCache(cachePath, cache)
+	},
+}
+
+// buildIDHeader returns a C header defining CTLOG_BUILD_ID, so devices can
+// identify which dictionary decodes their output.
+func buildIDHeader(id string) []byte {
+	return []byte(`/**
+ * Auto-generated tokenized logging build ID.
+ */
+
+#ifndef CTLOG_BUILD_ID_H
+#define CTLOG_BUILD_ID_H
+
+#define CTLOG_BUILD_ID  "` + id + `"
+
+#endif /* CTLOG_BUILD_ID_H */
+`)
+}
+
+func writeHeader(info *cmodule.Info, opts *cmodule.HeaderOptions) []byte {
+	var buf bytes.Buffer
+	if err := cmodule.WriteHeader(&buf, info, opts); err != nil {
+		cli.Fatalf("Error executing template: %v\n", err)
+	}
+	return buf.Bytes()
+}
+
+// readJSON decodes the JSON file at path into v and returns true if it was
+// successful.
+func readJSON(path string, v interface{}) bool {
+	if path == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func encodeJSON(v interface{}, compact bool) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if !compact {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		cli.Fatalf("Error encoding JSON: %v\n", err)
+	}
+	return buf.Bytes()
+}
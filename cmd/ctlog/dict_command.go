@@ -5,20 +5,31 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"os"
-	"time"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/jlubawy/go-cli"
 	"github.com/jlubawy/go-ctlog/cmodule"
 	"github.com/jlubawy/go-ctlog/ctlog"
+	"github.com/jlubawy/go-ctlog/project"
 )
 
 type DictOptions struct {
-	Compact bool
-	Output  string
+	Cache           string
+	Compact         bool
+	Config          string
+	Macros          macroSpecs
+	NoDefaultMacros bool
+	Output          string
+	Reproducible    bool
+	Root            string
 }
 
 var dictOptions DictOptions
@@ -26,65 +37,102 @@ var dictOptions DictOptions
 var dictCommand = cli.Command{
 	Name:             "dict",
 	ShortDescription: "create tokenized logging dictionary from a cmodule JSON file",
-	Description:      "Dict creates a tokenized logging dictionary from the provided cmodule JSON file.",
-	ShortUsage:       "[-output output] [cmodule JSON]",
+	Description:      "Dict creates a tokenized logging dictionary from the provided cmodule JSON file, or the project's modules JSON if none is provided.\n\nDict publish adds the provided dictionary, or the project's dictionary if none is provided, to a dictionary store so that output from any past build can be decoded with ctlog log -store:\n\n    ctlog dict publish [-config config] [-store store] [-tag tag]... [dictionary JSON]\n\nDict merge merges the dictionaries of firmware components sharing an output, each built with its own CTLOG_COMPONENT_ID, into one dictionary:\n\n    ctlog dict merge [-compact] [-output output] ID=dictionary.json...",
+	ShortUsage:       "[-cache cache] [-config config] [-macro NAME:FORMAT:COUNT:LEVEL]... [-output output] [-reproducible] [-root root] [cmodule JSON]",
 	SetupFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&dictOptions.Cache, "cache", "", "cache file used to skip unchanged source files or the project's if empty")
 		fs.BoolVar(&dictOptions.Compact, "compact", false, "output compact JSON")
+		fs.StringVar(&dictOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
+		fs.Var(&dictOptions.Macros, "macro", "additional logging macro spec NAME:FORMAT:COUNT:LEVEL, may be repeated")
+		fs.BoolVar(&dictOptions.NoDefaultMacros, "no-default-macros", false, "don't search for the default CTLOG_* macros")
 		fs.StringVar(&dictOptions.Output, "output", "", "output file or stdout if empty")
+		fs.BoolVar(&dictOptions.Reproducible, "reproducible", false, "output a fixed date")
+		fs.StringVar(&dictOptions.Root, "root", "", "project root that relative module paths are resolved against, or the project's directory if empty")
 	},
 	Run: func(args []string) {
-		if len(args) == 0 {
-			cli.Fatal("Must provide a cmodule JSON file.\n")
+		if len(args) > 0 {
+			switch args[0] {
+			case "merge":
+				runDictMerge(args[1:])
+				return
+			case "publish":
+				runDictPublish(args[1:])
+				return
+			}
 		}
 
-		if len(args) != 1 {
+		cfg, err := project.Open(dictOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
+		}
+
+		var (
+			input  string
+			output = dictOptions.Output
+		)
+
+		switch len(args) {
+		case 0:
+			if cfg == nil || cfg.Output.Modules == "" {
+				cli.Fatal("Must provide a cmodule JSON file.\n")
+			}
+			input = cfg.Path(cfg.Output.Modules)
+			if output == "" {
+				output = cfg.Path(cfg.Output.Dictionary)
+			}
+		case 1:
+			input = args[0]
+		default:
 			cli.Fatal("Only accepts one cmodule JSON file.\n")
 		}
 
-		f, err := os.Open(args[0])
+		f, err := os.Open(input)
 		if err != nil {
 			cli.Fatalf("Error opening modules JSON file: %v\n", err)
 		}
 
-		var info ModulesInfo
+		var info cmodule.Info
 		if err := json.NewDecoder(f).Decode(&info); err != nil {
 			f.Close()
 			cli.Fatalf("Error decoding modules JSON: %v\n", err)
 		}
 		f.Close()
 
-		var tlogInfo = TlogInfo{
-			Date:    time.Now().UTC(),
-			Modules: make([]ctlog.Module, 0),
+		x := newExtractor(cfg, dictOptions.NoDefaultMacros, dictOptions.Macros)
+
+		cachePath := dictOptions.Cache
+		if cachePath == "" && cfg != nil {
+			cachePath = cfg.Path(cfg.Cache)
 		}
+		cache := loadCache(cachePath)
 
-		for _, module := range info.Modules {
-			var mf *os.File
-			mf, err = os.Open(module.Path)
-			if err != nil {
-				cli.Fatalf("Error opening module file: %v\n", err)
-			}
+		root := dictOptions.Root
+		if root == "" {
+			root = projectDir(cfg)
+		}
+		modules := findModules(x, info.Modules, nil, root, cache)
+		saveCache(cachePath, cache)
 
-			lines, err := ctlog.FindLines(mf)
-			if err != nil {
-				mf.Close()
-				cli.Fatalf("Error finding module lines: %v\n", err)
-			}
-			mf.Close()
+		date, err := project.Date(dictOptions.Reproducible || (cfg != nil && cfg.Reproducible))
+		if err != nil {
+			cli.Fatalf("Error getting date: %v\n", err)
+		}
 
-			tlogInfo.Modules = append(tlogInfo.Modules, ctlog.Module{
-				Index: module.Index,
-				Name:  module.Name,
-				Path:  module.Path,
-				Lines: lines,
-			})
+		var dict = ctlog.Dictionary{
+			Date:    date,
+			Modules: modules,
 		}
+		if cfg != nil {
+			dict.LineConvention = cfg.LineConvention
+		}
+		dict.BuildID = dict.Fingerprint()
+		warnCollisions(&dict)
 
 		var w io.Writer
-		if dictOptions.Output == "" {
+		if output == "" {
 			w = os.Stdout
 		} else {
-			f, err := os.OpenFile(dictOptions.Output, os.O_CREATE|os.O_WRONLY, 0664)
+			f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
 			if err != nil {
 				cli.Fatalf("Error opening output file: %v\n", err)
 			}
@@ -97,19 +145,259 @@ var dictCommand = cli.Command{
 			enc.SetIndent("", "  ")
 		}
 
-		if err := enc.Encode(&tlogInfo); err != nil {
+		if err := enc.Encode(&dict); err != nil {
 			cli.Fatalf("Error encoding JSON: %v\n", err)
 		}
 	},
 }
 
-type TlogInfo struct {
-	Date    time.Time      `json:"date"`
-	Modules []ctlog.Module `json:"modules"`
+// runDictMerge runs the dict merge subcommand.
+func runDictMerge(args []string) {
+	var (
+		compact bool
+		output  string
+	)
+
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.BoolVar(&compact, "compact", false, "output compact JSON")
+	fs.StringVar(&output, "output", "", "output file or stdout if empty")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) == 0 {
+		cli.Fatal("Must provide at least one component dictionary.\n")
+	}
+
+	dicts := make(map[uint32]*ctlog.Dictionary)
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i == -1 {
+			cli.Fatalf("Component dictionary '%s' must be of the form ID=dictionary.json.\n", arg)
+		}
+		id, err := strconv.ParseUint(arg[:i], 10, 32)
+		if err != nil {
+			cli.Fatalf("Error parsing component ID '%s': %v\n", arg[:i], err)
+		}
+		if _, ok := dicts[uint32(id)]; ok {
+			cli.Fatalf("Component ID %d is used more than once.\n", id)
+		}
+
+		dict := new(ctlog.Dictionary)
+		if err := decodeJSONFile(arg[i+1:], dict); err != nil {
+			cli.Fatalf("Error reading dictionary JSON: %v\n", err)
+		}
+		dicts[uint32(id)] = dict
+	}
+
+	merged, err := ctlog.MergeDictionaries(dicts)
+	if err != nil {
+		cli.Fatalf("Error merging dictionaries: %v\n", err)
+	}
+
+	var w io.Writer
+	if output == "" {
+		w = os.Stdout
+	} else {
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+		if err != nil {
+			cli.Fatalf("Error opening output file: %v\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	if !compact {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(merged); err != nil {
+		cli.Fatalf("Error encoding JSON: %v\n", err)
+	}
+}
+
+// runDictPublish runs the dict publish subcommand.
+func runDictPublish(args []string) {
+	var (
+		config string
+		store  string
+		tags   stringList
+	)
+
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	fs.StringVar(&config, "config", "", "project configuration file or discovered from the working directory if empty")
+	fs.StringVar(&store, "store", "", "dictionary store directory or the project's if empty")
+	fs.Var(&tags, "tag", "version tag to give the dictionary, may be repeated")
+	fs.Parse(args)
+	args = fs.Args()
+
+	cfg, err := project.Open(config)
+	if err != nil {
+		cli.Fatalf("Error loading project configuration: %v\n", err)
+	}
+
+	var input string
+	switch len(args) {
+	case 0:
+		if cfg == nil || cfg.Output.Dictionary == "" {
+			cli.Fatal("Must provide a dictionary JSON file.\n")
+		}
+		input = cfg.Path(cfg.Output.Dictionary)
+	case 1:
+		input = args[0]
+	default:
+		cli.Fatal("Only accepts one dictionary JSON file.\n")
+	}
+
+	if store == "" && cfg != nil && cfg.Store != "" {
+		store = cfg.Path(cfg.Store)
+	}
+	if store == "" {
+		cli.Fatal("Must provide a dictionary store.\n")
+	}
+
+	var dict ctlog.Dictionary
+	if err := decodeJSONFile(input, &dict); err != nil {
+		cli.Fatalf("Error reading dictionary JSON: %v\n", err)
+	}
+
+	s, err := ctlog.OpenStore(store)
+	if err != nil {
+		cli.Fatalf("Error opening dictionary store: %v\n", err)
+	}
+	id, err := s.Publish(&dict, tags...)
+	if err != nil {
+		cli.Fatalf("Error publishing dictionary: %v\n", err)
+	}
+	cli.Info(fmt.Sprintf("Published build %s\n", id))
+}
+
+// stringList is a flag.Value that collects each use of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// newExtractor returns an extractor for the macros in the project
+// configuration, if any, and those provided on the command line.
+func newExtractor(cfg *project.Config, noDefaultMacros bool, macros []ctlog.MacroSpec) ctlog.Extractor {
+	var c project.Config
+	if cfg != nil {
+		c = *cfg
+	}
+	c.NoDefaultMacros = c.NoDefaultMacros || noDefaultMacros
+	c.Macros = append(c.Macros[:len(c.Macros):len(c.Macros)], macros...)
+
+	x, err := c.Extractor()
+	if err != nil {
+		cli.Fatalf("Error configuring macros: %v\n", err)
+	}
+	return x
+}
+
+// findModules finds the lines of each module. Relative module paths are
+// resolved against root, and visited holds the contents and info of any
+// modules that have already been read. The paths of the returned modules are
+// left unchanged.
+func findModules(x ctlog.Extractor, modules []cmodule.Module, visited map[string]ctlog.SourceFile, root string, cache *ctlog.Cache) []ctlog.Module {
+	sources := make([]ctlog.SourceFile, len(modules))
+	for i, module := range modules {
+		sources[i] = ctlog.SourceFile{
+			Index: module.Index,
+			Name:  module.Name,
+			Path:  module.Path,
+			Data:  visited[module.Path].Data,
+			Info:  visited[module.Path].Info,
+		}
+		if p := filepath.FromSlash(module.Path); !filepath.IsAbs(p) {
+			sources[i].Path = filepath.Join(root, p)
+		}
+	}
+
+	found, err := x.FindModules(sources, cache)
+	if err != nil {
+		cli.Fatalf("Error finding module lines: %v\n", err)
+	}
+	for i := range found {
+		found[i].Path = modules[i].Path
+	}
+	return found
+}
+
+// warnCollisions warns about logging calls in the dictionary that share a
+// token. They're only an error if one of them is logged.
+func warnCollisions(dict *ctlog.Dictionary) {
+	for _, c := range dict.Collisions() {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", c)
+	}
+}
+
+// projectDir returns the directory containing the project configuration, or
+// the working directory if there isn't one.
+func projectDir(cfg *project.Config) string {
+	if cfg != nil {
+		return cfg.Dir
+	}
+	return "."
+}
+
+// loadCache loads the line cache at path, or returns nil if path is empty. A
+// cache that can't be read is replaced by an empty one.
+func loadCache(path string) *ctlog.Cache {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ctlog.NewCache()
+	}
+	defer f.Close()
+
+	cache, err := ctlog.ReadCache(f)
+	if err != nil {
+		cli.Info(fmt.Sprintf("Ignoring invalid cache file: %v\n", err))
+		return ctlog.NewCache()
+	}
+	return cache
+}
+
+// saveCache saves the line cache to path, if there is one.
+func saveCache(path string, cache *ctlog.Cache) {
+	if path == "" || cache == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := cache.Encode(&buf); err != nil {
+		cli.Fatalf("Error encoding cache: %v\n", err)
+	}
+	if _, err := project.WriteFile(path, buf.Bytes(), 0664); err != nil {
+		cli.Fatalf("Error writing cache file: %v\n", err)
+	}
+}
+
+// macroSpecs is a flag.Value that accumulates macro specs.
+type macroSpecs []ctlog.MacroSpec
+
+func (specs *macroSpecs) String() string {
+	names := make([]string, len(*specs))
+	for i, spec := range *specs {
+		names[i] = spec.Name
+	}
+	return strings.Join(names, ",")
 }
 
-type ModulesInfo struct {
-	Date        time.Time        `json:"date"`
-	SearchPaths []string         `json:"searchPaths"`
-	Modules     []cmodule.Module `json:"modules"`
+func (specs *macroSpecs) Set(s string) error {
+	spec, err := ctlog.ParseMacroSpec(s)
+	if err != nil {
+		return err
+	}
+	*specs = append(*specs, spec)
+	return nil
 }
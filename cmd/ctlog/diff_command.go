@@ -0,0 +1,79 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctlog/ctlog"
+)
+
+type DiffOptions struct {
+	JSON   bool
+	Output string
+}
+
+var diffOptions DiffOptions
+
+var diffCommand = cli.Command{
+	Name:             "diff",
+	ShortDescription: "show the differences between two dictionaries",
+	Description: "Diff shows which log lines were added, removed, moved or reworded, " +
+		"and which modules changed index, between an old and new dictionary. " +
+		"Merged dictionaries are compared per component.",
+	ShortUsage: "[-json] [-output output] [old dictionary JSON] [new dictionary JSON]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&diffOptions.JSON, "json", false, "output JSON")
+		fs.StringVar(&diffOptions.Output, "output", "", "output file or stdout if empty")
+	},
+	Run: func(args []string) {
+		if len(args) != 2 {
+			cli.Fatal("Must provide an old and new dictionary JSON file.\n")
+		}
+
+		var old, new ctlog.Dictionary
+		if err := decodeJSONFile(args[0], &old); err != nil {
+			cli.Fatalf("Error reading old dictionary JSON file: %v\n", err)
+		}
+		if err := decodeJSONFile(args[1], &new); err != nil {
+			cli.Fatalf("Error reading new dictionary JSON file: %v\n", err)
+		}
+
+		diffs := old.Diff(&new)
+
+		var w io.Writer
+		if diffOptions.Output == "" {
+			w = os.Stdout
+		} else {
+			f, err := os.OpenFile(diffOptions.Output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+			if err != nil {
+				cli.Fatalf("Error opening output file: %v\n", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		if diffOptions.JSON {
+			if diffs == nil {
+				diffs = make([]ctlog.Diff, 0)
+			}
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(diffs); err != nil {
+				cli.Fatalf("Error encoding JSON: %v\n", err)
+			}
+			return
+		}
+
+		for _, diff := range diffs {
+			fmt.Fprintln(w, diff)
+		}
+	},
+}
@@ -6,18 +6,35 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
 
 	"github.com/jlubawy/go-cli"
 	"github.com/jlubawy/go-ctlog/ctlog"
+	"github.com/jlubawy/go-ctlog/project"
 )
 
 type LogOptions struct {
-	Output string
+	Config       string
+	Output       string
+	Store        string
+	Tag          string
+	Workers      int
+	Strict       bool
+	MaxLineSize  int
+	Inputs       stringList
+	Follow       bool
+	Listen       stringList
+	Connect      stringList
+	DevicePrefix string
 }
 
 var logOptions LogOptions
@@ -25,37 +42,77 @@ var logOptions LogOptions
 var logCommand = cli.Command{
 	Name:             "log",
 	ShortDescription: "translate tokenized logging output using the provided dictionary",
-	Description:      "Log translates tokenized logging output using the provided dictionary.",
-	ShortUsage:       "[-output output] [dictionary JSON]",
+	Description:      "Log translates tokenized logging output using the provided dictionary, or the project's dictionary if none is provided.\n\nWith -store the dictionary is looked up in a dictionary store each time a build ID line is output, so output from any published build can be decoded.\n\nLines that can't be decoded are output as is, or annotated if they are tokens that can't be translated, and a summary of them is printed at the end. With -strict log stops at the first token that can't be translated instead, lines that can't be decoded are still output as is.\n\nLines longer than -max-line bytes are truncated, and invalid UTF-8 and NUL bytes in lines that aren't tokenized are dropped as noise. The number of bytes discarded is printed at the end.\n\nInput is read from stdin unless -input is given. Each input may be a file, a quoted glob pattern or - for stdin, and they're decoded in order. gzip and zstd compressed inputs are decompressed, zstd using the zstd command. With -follow the last input file is followed as it's written to, including across log rotation.\n\nWith -listen or -connect output is read from TCP, UDP or Unix sockets instead. Each connection, or each remote address for UDP, is decoded independently and its lines are prefixed with its address. Lines dropped in transit are detected using their sequence numbers. Connections made with -connect are retried until log is interrupted.\n\nWhen several devices share the output, e.g. through a hub that prefixes each line with [dev3], -device-prefix gives a regular expression matching the prefix. The device ID is its group named device, else its first group, else the whole prefix. Each device's lines are prefixed with its ID and it has its own dictionary and sequence numbers.",
+	ShortUsage:       "[-config config] [-output output] [-store store [-tag tag]] [-workers n] [-strict] [-max-line n] [-input input]... [-follow] [-listen address]... [-connect address]... [-device-prefix regexp] [dictionary JSON]",
 	SetupFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&logOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
 		fs.StringVar(&logOptions.Output, "output", "", "output file or stdout if empty")
+		fs.StringVar(&logOptions.Store, "store", "", "dictionary store to look up build IDs in or the project's if empty")
+		fs.StringVar(&logOptions.Tag, "tag", "", "version tag or build ID of the dictionary to use until a build ID is output")
+		fs.IntVar(&logOptions.Workers, "workers", 0, "number of goroutines decoding in parallel or the number of CPUs if zero")
+		fs.BoolVar(&logOptions.Strict, "strict", false, "stop at the first token that can't be translated instead of annotating it and continuing")
+		fs.Var(&logOptions.Inputs, "input", "input file, glob pattern or - for stdin, may be repeated and defaults to stdin")
+		fs.BoolVar(&logOptions.Follow, "follow", false, "keep reading the last input file as it grows and across log rotation like tail -F")
+		fs.Var(&logOptions.Listen, "listen", "address to listen on for output like tcp://:4000, udp://:4000 or unix:///path, may be repeated")
+		fs.Var(&logOptions.Connect, "connect", "address to connect to for output like tcp://bridge:2000, may be repeated")
+		fs.StringVar(&logOptions.DevicePrefix, "device-prefix", "", "regular expression matching the device ID prefix of each line when several devices share the output, e.g. '^\\[(\\w+)\\] ', or the project's if empty")
+		fs.IntVar(&logOptions.MaxLineSize, "max-line", ctlog.DefaultMaxLineSize, "maximum size of a line in bytes, longer lines are truncated")
 	},
 	Run: func(args []string) {
-		if len(args) == 0 {
-			cli.Fatal("Must provide a dictionary JSON file.\n")
+		cfg, err := project.Open(logOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
 		}
 
-		if len(args) != 1 {
-			cli.Fatal("Only accepts one dictionary JSON file.\n")
+		storeDir := logOptions.Store
+		if storeDir == "" && cfg != nil && cfg.Store != "" {
+			storeDir = cfg.Path(cfg.Store)
 		}
 
-		f, err := os.Open(args[0])
-		if err != nil {
-			cli.Fatalf("Error opening dictionary JSON file: %v\n", err)
+		var store *ctlog.Store
+		if storeDir != "" {
+			if store, err = ctlog.OpenStore(storeDir); err != nil {
+				cli.Fatalf("Error opening dictionary store: %v\n", err)
+			}
+		} else if logOptions.Tag != "" {
+			cli.Fatal("Must provide a dictionary store to use a tag.\n")
+		}
+
+		var input string
+		switch len(args) {
+		case 0:
+			if cfg != nil && cfg.Output.Dictionary != "" {
+				input = cfg.Path(cfg.Output.Dictionary)
+			} else if store == nil {
+				cli.Fatal("Must provide a dictionary JSON file.\n")
+			}
+		case 1:
+			input = args[0]
+		default:
+			cli.Fatal("Only accepts one dictionary JSON file.\n")
 		}
 
-		var tlogInfo TlogInfo
-		if err := json.NewDecoder(f).Decode(&tlogInfo); err != nil {
-			f.Close()
-			cli.Fatalf("Error decoding dictionary JSON: %v\n", err)
+		var tx *ctlog.Translator
+		if input != "" && logOptions.Tag == "" {
+			var dict ctlog.Dictionary
+			if err := decodeJSONFile(input, &dict); err != nil {
+				cli.Fatalf("Error reading dictionary JSON: %v\n", err)
+			}
+			tx = ctlog.NewDictionaryTranslator(&dict)
+		}
+		if logOptions.Tag != "" {
+			dict, err := store.Lookup(logOptions.Tag)
+			if err != nil {
+				cli.Fatalf("Error looking up dictionary '%s': %v\n", logOptions.Tag, err)
+			}
+			tx = ctlog.NewDictionaryTranslator(dict)
 		}
-		f.Close()
 
 		var w io.Writer
 		if logOptions.Output == "" {
 			w = os.Stdout
 		} else {
-			f, err := os.OpenFile(logOptions.Output, os.O_CREATE|os.O_WRONLY, 0664)
+			f, err := os.OpenFile(logOptions.Output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
 			if err != nil {
 				cli.Fatalf("Error opening output file: %v\n", err)
 			}
@@ -63,22 +120,412 @@ var logCommand = cli.Command{
 			w = f
 		}
 
-		tx := ctlog.NewTranslator(tlogInfo.Modules)
-		s := bufio.NewScanner(os.Stdin)
-		for s.Scan() {
-			var out ctlog.Output
-			if err := json.Unmarshal(s.Bytes(), &out); err != nil {
-				fmt.Fprintln(w, s.Text())
-			} else {
-				s, err := tx.Translate(&out)
+		devicePrefix := logOptions.DevicePrefix
+		if devicePrefix == "" && cfg != nil {
+			devicePrefix = cfg.DevicePrefix
+		}
+
+		l := &logSession{
+			tx:        tx,
+			store:     store,
+			w:         bufio.NewWriter(w),
+			errCounts: make(map[string]int),
+		}
+		if devicePrefix != "" {
+			if l.devicePrefix, err = regexp.Compile(devicePrefix); err != nil {
+				cli.Fatalf("Error compiling device prefix: %v\n", err)
+			}
+		}
+
+		if len(logOptions.Listen) > 0 || len(logOptions.Connect) > 0 {
+			if len(logOptions.Inputs) > 0 || logOptions.Follow {
+				cli.Fatal("Can't use -input or -follow with -listen or -connect.\n")
+			}
+
+			var sources []ctlog.Source
+			for _, addr := range logOptions.Listen {
+				src, err := ctlog.Listen(addr)
 				if err != nil {
-					cli.Fatalf("Error translating tokenized logging output: %v\n", err)
+					cli.Fatalf("Error listening on %s: %v\n", addr, err)
 				}
-				fmt.Fprintln(w, s)
+				sources = append(sources, src)
 			}
+			for _, addr := range logOptions.Connect {
+				src, err := ctlog.Connect(addr, 0)
+				if err != nil {
+					cli.Fatalf("Error connecting to %s: %v\n", addr, err)
+				}
+				sources = append(sources, src)
+			}
+
+			// Stop accepting connections on an interrupt so the summary is
+			// still printed
+			onInterrupt(func() {
+				l.stop()
+				for _, src := range sources {
+					src.Close()
+				}
+			})
+
+			l.flush = true
+			l.serve(sources)
+			l.w.Flush()
+			printErrorSummary(l.errCounts, l.discarded, l.dropped)
+			return
+		}
+
+		patterns := []string(logOptions.Inputs)
+		if len(patterns) == 0 {
+			patterns = []string{ctlog.StdinName}
+		}
+		names, err := ctlog.ExpandInputs(patterns)
+		if err != nil {
+			cli.Fatalf("Error finding input files: %v\n", err)
+		}
+		if logOptions.Follow && names[len(names)-1] == ctlog.StdinName {
+			cli.Fatal("Can only follow an input file.\n")
 		}
-		if err := s.Err(); err != nil {
-			cli.Fatalf("Error scanning stdin: %v\n", err)
+
+		// The inputs are decoded as one stream so the dictionary chosen by a
+		// build ID carries over to the next input
+		s := &logStream{l: l, tx: tx}
+		for i, name := range names {
+			// Only the last input can be followed since it never ends
+			follow := logOptions.Follow && i == len(names)-1
+
+			var r io.ReadCloser
+			if follow {
+				var fl *ctlog.Follower
+				if fl, err = ctlog.Follow(name); err == nil {
+					// Stop following on an interrupt so the summary is still
+					// printed
+					onInterrupt(func() { fl.Close() })
+					r = fl
+				}
+			} else {
+				r, err = ctlog.OpenInput(name)
+			}
+			if err != nil {
+				l.fatalf("Error opening input: %v\n", err)
+			}
+
+			if len(names) > 1 || name != ctlog.StdinName {
+				s.name = name
+			}
+			// Live output is written as soon as each line is decoded rather
+			// than a chunk at a time by a pipeline
+			live := follow || ctlog.IsLiveInput(name)
+			if store == nil && l.devicePrefix == nil && !live {
+				// The dictionary can't change so lines can be decoded in
+				// parallel
+				s.decodeParallel(r)
+			} else {
+				l.flush = live
+				s.decode(r)
+			}
+			r.Close()
 		}
+
+		l.w.Flush()
+		printErrorSummary(l.errCounts, l.discarded, l.dropped)
 	},
 }
+
+// onInterrupt calls f when log is first interrupted or terminated. Another
+// interrupt stops log immediately.
+func onInterrupt(f func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		f()
+	}()
+}
+
+// A logSession writes the decoded output of the log command's inputs and
+// counts errors across them.
+type logSession struct {
+	tx           *ctlog.Translator // initial dictionary of each stream
+	store        *ctlog.Store
+	devicePrefix *regexp.Regexp
+
+	mu        sync.Mutex
+	w         *bufio.Writer
+	flush     bool // flush after each line for inputs that don't end
+	stopping  bool // connections are being closed
+	errCounts map[string]int
+	discarded int64
+	dropped   int
+}
+
+func (l *logSession) fatalf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.w.Flush()
+	cli.Fatalf(format, args...)
+}
+
+func (l *logSession) onError(line int, err error) {
+	l.mu.Lock()
+	l.errCounts[errorKind(err)]++
+	l.mu.Unlock()
+}
+
+func (l *logSession) writeLine(prefix string, line []byte) {
+	l.mu.Lock()
+	l.w.WriteString(prefix)
+	l.w.Write(line)
+	l.w.WriteByte('\n')
+	if l.flush {
+		l.w.Flush()
+	}
+	l.mu.Unlock()
+}
+
+func (l *logSession) stop() {
+	l.mu.Lock()
+	l.stopping = true
+	l.mu.Unlock()
+}
+
+func (l *logSession) isStopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+// serve decodes each stream from the sources concurrently until they're
+// closed.
+func (l *logSession) serve(sources []ctlog.Source) {
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src ctlog.Source) {
+			defer wg.Done()
+			for {
+				stream, err := src.Next()
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					if l.isStopping() {
+						return
+					}
+					l.fatalf("Error accepting connection: %v\n", err)
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer stream.Close()
+
+					name := stream.Name()
+					fmt.Fprintf(os.Stderr, "Connected to %s.\n", name)
+					s := &logStream{
+						l:      l,
+						tx:     l.tx,
+						name:   name,
+						prefix: "[" + name + "] ",
+						seq:    new(ctlog.SequenceTracker),
+						remote: true,
+					}
+					s.decode(stream)
+					fmt.Fprintf(os.Stderr, "Disconnected from %s.\n", name)
+				}()
+			}
+		}(src)
+	}
+	wg.Wait()
+}
+
+// A logStream decodes one stream of output, keeping its own dictionary and
+// sequence numbers, and those of each device in it if there's a device
+// prefix.
+type logStream struct {
+	l      *logSession
+	tx     *ctlog.Translator
+	name   string                 // name of the input or empty for stdin
+	prefix string                 // prepended to each line
+	seq    *ctlog.SequenceTracker // tracks dropped lines if not nil
+	remote bool                   // a read error ends the stream instead of stopping log
+
+	devices map[string]*logStream
+	line    bytes.Buffer
+}
+
+// where returns where in the input line is for error messages.
+func (s *logStream) where(line int) string {
+	if s.name == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s: line %d", s.name, line)
+}
+
+// device returns the stream of the device with the given ID, which starts
+// with the initial dictionary.
+func (s *logStream) device(id string) *logStream {
+	ds, ok := s.devices[id]
+	if !ok {
+		if s.devices == nil {
+			s.devices = make(map[string]*logStream)
+		}
+		ds = &logStream{
+			l:      s.l,
+			tx:     s.l.tx,
+			name:   s.name,
+			prefix: s.prefix + "[" + id + "] ",
+			seq:    new(ctlog.SequenceTracker),
+		}
+		s.devices[id] = ds
+	}
+	return ds
+}
+
+// decodeParallel decodes r using a pipeline.
+func (s *logStream) decodeParallel(r io.Reader) {
+	p := ctlog.Pipeline{
+		Translator:      s.tx,
+		Workers:         logOptions.Workers,
+		MaxLineSize:     logOptions.MaxLineSize,
+		OnError:         s.l.onError,
+		StrictTranslate: logOptions.Strict,
+	}
+	if err := p.Decode(r, s.l.w); err != nil {
+		if s.name != "" {
+			err = fmt.Errorf("%s: %v", s.name, err)
+		}
+		s.l.fatalf("Error translating tokenized logging output: %v\n", err)
+	}
+	s.l.discarded += p.Discarded
+}
+
+// decode decodes r one line at a time, switching dictionaries whenever a
+// build ID is output if there's a store.
+func (s *logStream) decode(r io.Reader) {
+	l := s.l
+	d := ctlog.NewDecoder(r)
+	d.MaxLineSize = logOptions.MaxLineSize
+	d.DevicePrefix = l.devicePrefix
+	defer func() {
+		l.mu.Lock()
+		l.discarded += d.Discarded()
+		l.mu.Unlock()
+	}()
+
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+
+		ds := s
+		if rec.Device != "" {
+			ds = s.device(rec.Device)
+		}
+
+		if serr, ok := err.(*ctlog.SyntaxError); ok {
+			l.onError(rec.Line, serr)
+			l.writeLine(ds.prefix, rec.Data)
+		} else if err != nil {
+			if s.name != "" {
+				err = fmt.Errorf("%s: %v", s.name, err)
+			}
+			if s.remote {
+				if !l.isStopping() {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+				return
+			}
+			l.fatalf("Error decoding tokenized logging output: %v\n", err)
+		} else {
+			ds.output(&rec)
+		}
+	}
+}
+
+// output translates and writes a record.
+func (s *logStream) output(rec *ctlog.Record) {
+	l := s.l
+	s.line.Reset()
+
+	if !rec.IsToken() {
+		if id, ok := ctlog.ParseBuildID(rec.Data); ok && l.store != nil {
+			dict, err := l.store.Lookup(id)
+			if err != nil {
+				// Output is left untranslated until a known build is seen
+				// rather than decoded with the wrong dictionary
+				fmt.Fprintf(os.Stderr, "Warning: build %s: %v\n", id, err)
+				s.tx = nil
+			} else {
+				s.tx = ctlog.NewDictionaryTranslator(dict)
+			}
+		}
+		s.line.Write(rec.Data)
+	} else {
+		if s.seq != nil {
+			if n := s.seq.Track(&rec.Output); n > 0 {
+				l.mu.Lock()
+				l.dropped += n
+				l.mu.Unlock()
+				l.writeLine(s.prefix, []byte(fmt.Sprintf("<%d line(s) dropped>", n)))
+			}
+		}
+
+		if s.tx == nil {
+			s.line.Write(rec.Data)
+		} else {
+			str, err := s.tx.Translate(&rec.Output)
+			if err != nil {
+				if logOptions.Strict {
+					l.fatalf("Error translating tokenized logging output: %s: %v\n", s.where(rec.Line), err)
+				}
+				l.onError(rec.Line, err)
+				str = ctlog.FormatUnknown(&rec.Output)
+			}
+			s.line.Write(rec.Leading)
+			s.line.WriteString(str)
+			s.line.Write(rec.Trailing)
+		}
+	}
+
+	l.writeLine(s.prefix, s.line.Bytes())
+}
+
+// errorKind returns the kind of decoding error err is for summarizing.
+func errorKind(err error) string {
+	switch e := err.(type) {
+	case *ctlog.TranslateError:
+		return e.Kind.String()
+	case *ctlog.SyntaxError:
+		return "invalid " + e.Encoding.String() + " record"
+	default:
+		return "other"
+	}
+}
+
+// printErrorSummary prints the number of lines that couldn't be decoded of
+// each kind, the number of bytes discarded and the number of lines dropped
+// to stderr, if there were any.
+func printErrorSummary(counts map[string]int, discarded int64, dropped int) {
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "%d line(s) were dropped according to their sequence numbers.\n", dropped)
+	}
+	if discarded > 0 {
+		fmt.Fprintf(os.Stderr, "Discarded %d byte(s) of noise and truncated lines.\n", discarded)
+	}
+	if len(counts) == 0 {
+		return
+	}
+
+	kinds := make([]string, 0, len(counts))
+	total := 0
+	for kind, n := range counts {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(os.Stderr, "%d line(s) couldn't be decoded:\n", total)
+	for _, kind := range kinds {
+		fmt.Fprintf(os.Stderr, "  %6d %s\n", counts[kind], kind)
+	}
+}
@@ -10,8 +10,11 @@ var program = cli.Program{
 	Name:        "ctlog",
 	Description: "Ctlog is a program for managing tokenized logging projects.",
 	Commands: []cli.Command{
+		buildCommand,
 		dictCommand,
+		diffCommand,
 		logCommand,
+		verifyCommand,
 	},
 }
 
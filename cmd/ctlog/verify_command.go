@@ -0,0 +1,148 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctlog/cmodule"
+	"github.com/jlubawy/go-ctlog/ctlog"
+	"github.com/jlubawy/go-ctlog/project"
+)
+
+type VerifyOptions struct {
+	Cache           string
+	Component       int64
+	Config          string
+	Macros          macroSpecs
+	Modules         string
+	NoDefaultMacros bool
+	Root            string
+}
+
+var verifyOptions VerifyOptions
+
+var verifyCommand = cli.Command{
+	Name:             "verify",
+	ShortDescription: "check a dictionary against the current source tree",
+	Description: "Verify rebuilds the dictionary from the cmodule JSON file, or the project's modules JSON if none is provided, " +
+		"and compares it with the provided dictionary, or the project's dictionary if none is provided. " +
+		"Any differences are reported and verify exits with a non-zero status. " +
+		"A merged dictionary is verified one component at a time using -component.",
+	ShortUsage: "[-cache cache] [-component id] [-config config] [-macro NAME:FORMAT:COUNT:LEVEL]... [-modules cmodule JSON] [-root root] [dictionary JSON]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&verifyOptions.Cache, "cache", "", "cache file read to skip unchanged source files or the project's if empty")
+		fs.Int64Var(&verifyOptions.Component, "component", -1, "ID of the component of a merged dictionary built from the source tree")
+		fs.StringVar(&verifyOptions.Config, "config", "", "project configuration file or discovered from the working directory if empty")
+		fs.Var(&verifyOptions.Macros, "macro", "additional logging macro spec NAME:FORMAT:COUNT:LEVEL, may be repeated")
+		fs.StringVar(&verifyOptions.Modules, "modules", "", "cmodule JSON file or the project's if empty")
+		fs.BoolVar(&verifyOptions.NoDefaultMacros, "no-default-macros", false, "don't search for the default CTLOG_* macros")
+		fs.StringVar(&verifyOptions.Root, "root", "", "project root that relative module paths are resolved against, or the project's directory if empty")
+	},
+	Run: func(args []string) {
+		cfg, err := project.Open(verifyOptions.Config)
+		if err != nil {
+			cli.Fatalf("Error loading project configuration: %v\n", err)
+		}
+
+		modulesPath := verifyOptions.Modules
+		if modulesPath == "" && cfg != nil {
+			modulesPath = cfg.Path(cfg.Output.Modules)
+		}
+		if modulesPath == "" {
+			cli.Fatal("Must provide a cmodule JSON file.\n")
+		}
+
+		var dictPath string
+		switch len(args) {
+		case 0:
+			if cfg == nil || cfg.Output.Dictionary == "" {
+				cli.Fatal("Must provide a dictionary JSON file.\n")
+			}
+			dictPath = cfg.Path(cfg.Output.Dictionary)
+		case 1:
+			dictPath = args[0]
+		default:
+			cli.Fatal("Only accepts one dictionary JSON file.\n")
+		}
+
+		var info cmodule.Info
+		if err := decodeJSONFile(modulesPath, &info); err != nil {
+			cli.Fatalf("Error reading modules JSON file: %v\n", err)
+		}
+
+		var dict ctlog.Dictionary
+		if err := decodeJSONFile(dictPath, &dict); err != nil {
+			cli.Fatalf("Error reading dictionary JSON file: %v\n", err)
+		}
+		exp := ctlog.Dictionary{
+			LineConvention: dict.LineConvention,
+			Modules:        componentModules(&dict, verifyOptions.Component),
+		}
+
+		x := newExtractor(cfg, verifyOptions.NoDefaultMacros, verifyOptions.Macros)
+
+		cachePath := verifyOptions.Cache
+		if cachePath == "" && cfg != nil {
+			cachePath = cfg.Path(cfg.Cache)
+		}
+		cache := loadCache(cachePath)
+
+		root := verifyOptions.Root
+		if root == "" {
+			root = projectDir(cfg)
+		}
+		// The cache is only read, verify doesn't write to the project
+		modules := findModules(x, info.Modules, nil, root, cache)
+
+		src := ctlog.Dictionary{Modules: modules}
+		if cfg != nil {
+			src.LineConvention = cfg.LineConvention
+		}
+		diffs := exp.Diff(&src)
+		if len(diffs) > 0 {
+			for _, diff := range diffs {
+				fmt.Println(diff)
+			}
+			cli.Fatalf("Dictionary %s doesn't match the source tree, found %d difference(s).\n", dictPath, len(diffs))
+		}
+	},
+}
+
+// componentModules returns the modules of the component of a merged
+// dictionary with the given ID, or the dictionary's modules if it isn't merged
+// and id is -1.
+func componentModules(dict *ctlog.Dictionary, id int64) []ctlog.Module {
+	if len(dict.Components) == 0 {
+		if id >= 0 {
+			cli.Fatal("Dictionary isn't merged, -component can't be used.\n")
+		}
+		return dict.Modules
+	}
+	if id < 0 {
+		cli.Fatal("Dictionary is merged, must provide the -component built from the source tree.\n")
+	}
+	for _, c := range dict.Components {
+		if int64(c.ID) == id {
+			return c.Modules
+		}
+	}
+	cli.Fatalf("Dictionary doesn't have component %d.\n", id)
+	return nil
+}
+
+// decodeJSONFile decodes the JSON file at path into v.
+func decodeJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
@@ -8,7 +8,9 @@ Package cmodule.
 package cmodule
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,7 +18,28 @@ import (
 	"github.com/jlubawy/go-ctext/cmacro"
 )
 
-const MacroFuncName = "CMODULE_DEFINE"
+const (
+	// MacroFuncName is the macro used to define a module in a C or C++ source
+	// file.
+	MacroFuncName = "CMODULE_DEFINE"
+
+	// HeaderMacroFuncName is the macro used to define a module in a header
+	// file. It may be used more than once within the same header (e.g. once in
+	// each static inline function) as long as the module name is the same.
+	HeaderMacroFuncName = "CMODULE_DEFINE_HEADER"
+)
+
+// DefaultExtensions are the C and C++ source and header file extensions that
+// are searched for module definitions when none are provided.
+var DefaultExtensions = []string{
+	".c",
+	".cc",
+	".cpp",
+	".cxx",
+	".h",
+	".hh",
+	".hpp",
+}
 
 type Module struct {
 	// Index is the index in the sorted module slice.
@@ -25,13 +48,17 @@ type Module struct {
 	// Name is the name of the module. Modules are sorted by name.
 	Name string `json:"name"`
 
-	// Path is the absolute path to the C source file.
+	// Path is the absolute path to the C source file, or the path relative to
+	// the project root if the modules were found by a Walker with a Root.
 	Path string `json:"path"`
 }
 
 type modulesByName []Module
 
 func (x modulesByName) Less(i, j int) bool {
+	if x[i].Name == x[j].Name {
+		return x[i].Path < x[j].Path
+	}
 	return x[i].Name < x[j].Name
 }
 
@@ -43,21 +70,56 @@ func (x modulesByName) Swap(i, j int) {
 	x[i], x[j] = x[j], x[i]
 }
 
+// A Walker walks directories and finds all modules within them.
+type Walker struct {
+	// Extensions are the file extensions, including the leading dot, that are
+	// searched for module definitions. If empty DefaultExtensions is used.
+	Extensions []string
+
+	// Excludes are filepath.Match patterns of files and directories to skip.
+	// Each pattern is matched against both the base name and the slash
+	// separated path relative to the directory being walked.
+	Excludes []string
+
+	// Visit, if not nil, is called with the contents of each file that
+	// defines a module so that it can be processed further without being read
+	// again, along with the file's info from before it was read. The module's
+	// Index isn't known until walking is complete so it isn't set. Any error
+	// returned stops the walk.
+	Visit func(module Module, info os.FileInfo, data []byte) error
+
+	// Root, if not empty, is the directory that module paths are made
+	// relative to. This allows the output to be reproduced on machines where
+	// the project is checked out to a different directory.
+	Root string
+}
+
 // WalkDirs walks multiples directories and finds all modules within the given
 // directories.
 func WalkDirs(roots ...string) (modules []Module, err error) {
+	return new(Walker).WalkDirs(roots...)
+}
+
+// WalkDir walks a directory and finds all modules within that given directory.
+func WalkDir(root string) (modules []Module, err error) {
+	return new(Walker).WalkDir(root)
+}
+
+// WalkDirs walks multiples directories and finds all modules within the given
+// directories.
+func (w *Walker) WalkDirs(roots ...string) (modules []Module, err error) {
 	modules = make([]Module, 0)
 
 	for _, root := range roots {
 		var ms []Module
-		ms, err = walkDir(root)
+		ms, err = w.walkDir(root)
 		if err != nil {
 			return
 		}
 		modules = append(modules, ms...)
 	}
 
-	sort.Sort(modulesByName(modules))
+	sort.Stable(modulesByName(modules))
 	for i := 0; i < len(modules); i++ {
 		modules[i].Index = i
 	}
@@ -66,21 +128,63 @@ func WalkDirs(roots ...string) (modules []Module, err error) {
 }
 
 // WalkDir walks a directory and finds all modules within that given directory.
-func WalkDir(root string) (modules []Module, err error) {
-	modules, err = walkDir(root)
+func (w *Walker) WalkDir(root string) (modules []Module, err error) {
+	return w.WalkDirs(root)
+}
+
+// SearchPaths returns the given roots as they should be recorded alongside the
+// modules found in them, i.e. absolute paths or paths relative to w.Root.
+func (w *Walker) SearchPaths(roots ...string) (paths []string, err error) {
+	paths = make([]string, len(roots))
+	for i, root := range roots {
+		if w.Root == "" {
+			paths[i], err = PathAbsToSlash(root)
+		} else {
+			paths[i], err = PathRelToSlash(w.Root, root)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *Walker) hasExtension(path string) bool {
+	exts := w.Extensions
+	if len(exts) == 0 {
+		exts = DefaultExtensions
+	}
+
+	ext := filepath.Ext(path)
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Walker) isExcluded(root, path string) (excluded bool, err error) {
+	var rel string
+	rel, err = filepath.Rel(root, path)
 	if err != nil {
 		return
 	}
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(path)
 
-	sort.Sort(modulesByName(modules))
-	for i := 0; i < len(modules); i++ {
-		modules[i].Index = i
+	for _, pattern := range w.Excludes {
+		for _, name := range []string{base, rel} {
+			excluded, err = filepath.Match(pattern, name)
+			if err != nil || excluded {
+				return
+			}
+		}
 	}
-
 	return
 }
 
-func walkDir(root string) (modules []Module, err error) {
+func (w *Walker) walkDir(root string) (modules []Module, err error) {
 	modules = make([]Module, 0)
 
 	walkFn := func(path string, info os.FileInfo, err1 error) (err error) {
@@ -90,48 +194,72 @@ func walkDir(root string) (modules []Module, err error) {
 			return
 		}
 
+		if path != root {
+			var excluded bool
+			excluded, err = w.isExcluded(root, path)
+			if err != nil {
+				return
+			}
+			if excluded {
+				if info.IsDir() {
+					err = filepath.SkipDir
+				}
+				return
+			}
+		}
+
 		if info.IsDir() {
 			return // skip directories
 		}
 
-		ext := filepath.Ext(path)
-		if ext != ".c" {
-			return // skip files that aren't C source
+		if !w.hasExtension(path) {
+			return // skip files that aren't C or C++ source
+		}
+
+		// Stat the file before it's read, following any symlink, so the info
+		// passed to Visit is never newer than the data
+		if w.Visit != nil {
+			if info, err = os.Stat(path); err != nil {
+				return
+			}
 		}
 
-		// Convert path to absolute path
-		path, err = PathAbsToSlash(path)
+		var data []byte
+		data, err = ioutil.ReadFile(path)
 		if err != nil {
 			return
 		}
 
-		var f *os.File
-		f, err = os.Open(path)
+		// Convert path to absolute path, or relative to the root
+		if w.Root == "" {
+			path, err = PathAbsToSlash(path)
+		} else {
+			path, err = PathRelToSlash(w.Root, path)
+		}
 		if err != nil {
 			return
 		}
-		defer f.Close()
 
-		count := 0
-		err = cmacro.ScanInvocations(f, func(inv cmacro.Invocation) {
-			if len(inv.Args) != 1 {
-				err = fmt.Errorf("expected a single argument in the module definition but got %d", len(inv.Args))
-				return
-			}
-
-			modules = append(modules, Module{
-				Name: inv.Args[0],
-				Path: path,
-			})
-		}, MacroFuncName)
+		var name string
+		name, err = findModuleName(data)
 		if err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
 			return
 		}
+		if name == "" {
+			return // no module defined in this file
+		}
 
-		if count > 1 {
-			err = fmt.Errorf("more than one module definition found in %s", path)
-			return
+		module := Module{
+			Name: name,
+			Path: path,
 		}
+		if w.Visit != nil {
+			if err = w.Visit(module, info, data); err != nil {
+				return
+			}
+		}
+		modules = append(modules, module)
 
 		return
 	}
@@ -143,6 +271,56 @@ func walkDir(root string) (modules []Module, err error) {
 	return
 }
 
+// findModuleName returns the name of the module defined within the C source
+// data, or an empty string if there isn't one.
+func findModuleName(data []byte) (name string, err error) {
+	var names []string
+
+	scan := func(macroName string) (n int, err error) {
+		var scanErr error
+		err = cmacro.ScanInvocations(bytes.NewReader(data), func(inv cmacro.Invocation) {
+			if scanErr != nil {
+				return
+			}
+			if len(inv.Args) != 1 {
+				scanErr = fmt.Errorf("expected a single argument in the module definition but got %d", len(inv.Args))
+				return
+			}
+			names = append(names, inv.Args[0])
+			n += 1
+		}, macroName)
+		if err != nil {
+			return
+		}
+		err = scanErr
+		return
+	}
+
+	var nDefines int
+	nDefines, err = scan(MacroFuncName)
+	if err != nil {
+		return
+	}
+	if nDefines > 1 {
+		err = fmt.Errorf("more than one module definition found")
+		return
+	}
+
+	_, err = scan(HeaderMacroFuncName)
+	if err != nil {
+		return
+	}
+
+	for _, n := range names {
+		if name != "" && name != n {
+			err = fmt.Errorf("conflicting module definitions '%s' and '%s'", name, n)
+			return
+		}
+		name = n
+	}
+	return
+}
+
 // PathAbsToSlash returns an absolute path with / slash characters.
 func PathAbsToSlash(p string) (cp string, err error) {
 	cp, err = filepath.Abs(p)
@@ -152,3 +330,22 @@ func PathAbsToSlash(p string) (cp string, err error) {
 	cp = filepath.ToSlash(cp)
 	return
 }
+
+// PathRelToSlash returns the path of p relative to root with / slash
+// characters.
+func PathRelToSlash(root, p string) (cp string, err error) {
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return
+	}
+	cp, err = filepath.Abs(p)
+	if err != nil {
+		return
+	}
+	cp, err = filepath.Rel(root, cp)
+	if err != nil {
+		return
+	}
+	cp = filepath.ToSlash(cp)
+	return
+}
@@ -5,7 +5,9 @@
 package cmodule
 
 import (
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -94,3 +96,132 @@ func TestWalkDir(t *testing.T) {
 		}
 	}
 }
+
+func TestWalkerExtensions(t *testing.T) {
+	var cases = []struct {
+		Extensions []string
+		Modules    []Module
+	}{
+		{
+			Extensions: nil,
+			Modules: []Module{
+				{
+					Name: "module_a",
+					Path: "testdata/walkext/module_a.c",
+				},
+				{
+					Name: "module_b",
+					Path: "testdata/walkext/module_b.cpp",
+				},
+				{
+					Name: "module_c_h",
+					Path: "testdata/walkext/module_c.h",
+				},
+			},
+		},
+		{
+			Extensions: []string{".c", ".txt"},
+			Modules: []Module{
+				{
+					Name: "module_a",
+					Path: "testdata/walkext/module_a.c",
+				},
+				{
+					Name: "module_d",
+					Path: "testdata/walkext/module_d.txt",
+				},
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		for j := 0; j < len(tc.Modules); j++ {
+			tc.Modules[j].Index = j
+			cp, err := PathAbsToSlash(tc.Modules[j].Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.Modules[j].Path = cp
+		}
+
+		w := Walker{Extensions: tc.Extensions}
+		modules, err := w.WalkDir("testdata/walkext")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(modules, tc.Modules) {
+			t.Error("data mismatch")
+			t.Log(modules)
+			t.Log(tc.Modules)
+		}
+	}
+}
+
+func TestWalkDirConflict(t *testing.T) {
+	if _, err := WalkDir("testdata/walkconflict"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWalkerExcludes(t *testing.T) {
+	for _, excludes := range [][]string{{"b"}, {"module_3.c"}, {"b/*.c"}} {
+		w := Walker{Excludes: excludes}
+		modules, err := w.WalkDir("testdata/walkdirs")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(modules) != 2 || modules[0].Name != "module_1" || modules[1].Name != "module_2" {
+			t.Errorf("excludes %q: unexpected modules %v", excludes, modules)
+		}
+	}
+}
+
+func TestWalkerVisit(t *testing.T) {
+	visited := make(map[string]string)
+
+	w := Walker{
+		Visit: func(module Module, info os.FileInfo, data []byte) error {
+			if info.Size() != int64(len(data)) {
+				t.Errorf("module %s: expected size %d but got %d", module.Name, len(data), info.Size())
+			}
+			visited[module.Name] = string(data)
+			return nil
+		},
+	}
+	modules, err := w.WalkDir("testdata/walkdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(visited) != len(modules) {
+		t.Fatalf("expected %d modules visited but got %d", len(modules), len(visited))
+	}
+	for _, module := range modules {
+		if !strings.Contains(visited[module.Name], "CMODULE_DEFINE( "+module.Name+" );") {
+			t.Errorf("unexpected data for module %s: %q", module.Name, visited[module.Name])
+		}
+	}
+}
+
+func TestWalkerRoot(t *testing.T) {
+	w := Walker{Root: "testdata"}
+	modules, err := w.WalkDirs("testdata/walkdirs/b", "testdata/walkdirs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exp = []Module{
+		{Index: 0, Name: "module_1", Path: "walkdirs/a/module_1.c"},
+		{Index: 1, Name: "module_2", Path: "walkdirs/a/module_2.c"},
+		{Index: 2, Name: "module_3", Path: "walkdirs/b/module_3.c"},
+	}
+	if !reflect.DeepEqual(modules, exp) {
+		t.Error("data mismatch")
+		t.Log(modules)
+		t.Log(exp)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmodule
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultHeaderGuard is the include guard used by generated headers.
+const DefaultHeaderGuard = "CMODULE_INDICES_H"
+
+// Info is the module information output by the cmodule tool.
+type Info struct {
+	Date        time.Time `json:"date"`
+	SearchPaths []string  `json:"searchPaths"`
+	Modules     []Module  `json:"modules"`
+}
+
+// HeaderOptions are options used when generating a module indices header.
+type HeaderOptions struct {
+	// Guard is the include guard macro name. If empty DefaultHeaderGuard is
+	// used.
+	Guard string `json:"guard,omitempty"`
+
+	// Defines are additional macros defined in the header, for example to
+	// set CTLOG_LEVELS_ENABLED project-wide.
+	Defines map[string]string `json:"defines,omitempty"`
+}
+
+type define struct {
+	Name  string
+	Value string
+}
+
+// WriteHeader writes a C header file containing the module index definitions
+// in info.
+func WriteHeader(w io.Writer, info *Info, opts *HeaderOptions) error {
+	if opts == nil {
+		opts = new(HeaderOptions)
+	}
+
+	guard := opts.Guard
+	if guard == "" {
+		guard = DefaultHeaderGuard
+	}
+
+	defines := make([]define, 0, len(opts.Defines))
+	for name, value := range opts.Defines {
+		defines = append(defines, define{Name: name, Value: value})
+	}
+	sort.Slice(defines, func(i, j int) bool { return defines[i].Name < defines[j].Name })
+
+	return templHeader.Execute(w, struct {
+		*Info
+		Guard   string
+		Defines []define
+	}{
+		Info:    info,
+		Guard:   guard,
+		Defines: defines,
+	})
+}
+
+const (
+	headerDatePrefix = "// Generated on: "
+	headerDateLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+)
+
+// HeaderDate returns the date recorded in a header written by WriteHeader, so
+// it can be kept when regenerating a header that hasn't otherwise changed.
+func HeaderDate(header []byte) (date time.Time, ok bool) {
+	s := bufio.NewScanner(bytes.NewReader(header))
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, headerDatePrefix) {
+			var err error
+			date, err = time.Parse(headerDateLayout, strings.TrimPrefix(line, headerDatePrefix))
+			ok = err == nil
+			return
+		}
+	}
+	return
+}
+
+var templHeader = template.Must(template.New("").Parse(`/**
+ * Auto-generated module index definitions for a given project.
+ */
+
+// Generated on: {{.Date}}
+// Using search paths:
+{{range .SearchPaths}}{{printf "//   - %s" .}}
+{{end}}
+
+#ifndef {{.Guard}}
+#define {{.Guard}}
+
+/*==============================================================================
+ *                                   Defines
+ *============================================================================*/
+/*============================================================================*/
+{{range .Defines}}#define {{.Name}}{{if .Value}}  {{.Value}}{{end}}
+{{end}}{{if .Defines}}
+/*============================================================================*/
+{{end}}{{range $moduleIdx, $module := .Modules}}#define CMODULE_INDEX_{{printf "%-32s" $module.Name}}  ({{$module.Index}})
+{{end}}
+
+#endif /* {{.Guard}} */
+`))
@@ -0,0 +1,57 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmodule
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteHeader(t *testing.T) {
+	info := Info{
+		Date:        time.Date(2018, 6, 28, 0, 0, 0, 0, time.UTC),
+		SearchPaths: []string{"/path/to/src"},
+		Modules: []Module{
+			{Index: 0, Name: "gpio", Path: "/path/to/src/gpio.c"},
+			{Index: 1, Name: "main", Path: "/path/to/src/main.c"},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := WriteHeader(&buf, &info, &HeaderOptions{
+		Guard:   "APP_INDICES_H",
+		Defines: map[string]string{"B": "(2)", "A": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+
+	for _, exp := range []string{
+		"//   - /path/to/src\n",
+		"#ifndef APP_INDICES_H\n#define APP_INDICES_H\n",
+		"#define A\n#define B  (2)\n",
+		"#define CMODULE_INDEX_gpio                              (0)\n",
+		"#define CMODULE_INDEX_main                              (1)\n",
+		"#endif /* APP_INDICES_H */\n",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("expected header to contain %q", exp)
+		}
+	}
+	if t.Failed() {
+		t.Log(s)
+	}
+
+	date, ok := HeaderDate(buf.Bytes())
+	if !ok || !date.Equal(info.Date) {
+		t.Errorf("expected date %v but got %v", info.Date, date)
+	}
+	if _, ok := HeaderDate([]byte("#define A\n")); ok {
+		t.Error("expected no date")
+	}
+}
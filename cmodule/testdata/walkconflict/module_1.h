@@ -0,0 +1,12 @@
+
+static inline void
+module_1_first( void )
+{
+    CMODULE_DEFINE_HEADER( module_1_h );
+}
+
+static inline void
+module_1_second( void )
+{
+    CMODULE_DEFINE_HEADER( module_2_h );
+}
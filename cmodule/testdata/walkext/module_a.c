@@ -0,0 +1,2 @@
+
+CMODULE_DEFINE( module_a );
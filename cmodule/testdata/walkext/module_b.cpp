@@ -0,0 +1,6 @@
+
+CMODULE_DEFINE( module_b );
+
+namespace b {
+void run() {}
+}
@@ -0,0 +1,17 @@
+
+#ifndef MODULE_C_H
+#define MODULE_C_H
+
+static inline void
+module_c_first( void )
+{
+    CMODULE_DEFINE_HEADER( module_c_h );
+}
+
+static inline void
+module_c_second( void )
+{
+    CMODULE_DEFINE_HEADER( module_c_h );
+}
+
+#endif
@@ -0,0 +1,315 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Base64Prefix is the character that starts a base64 encoded binary record
+// in a line of output, as written by ctlog_base64_fprintf.
+//
+// The binary record is encoded using the standard base64 alphabet without
+// padding, so it can share a console with plain text without confusing
+// terminals or line-based tools. It is:
+//
+//	version         byte
+//	component       uvarint, only for Version1 and later
+//	sequence        uvarint
+//	level           byte, the level's character
+//	module index    uvarint
+//	line number     uvarint
+//	argument count  uvarint
+//
+// followed by each argument's type byte and value. Bools and characters are a
+// single byte, ints are zig-zag encoded varints, uints are uvarints and
+// strings are their length as a uvarint followed by their bytes. Varints are
+// encoded like encoding/binary.
+const Base64Prefix = '~'
+
+// minBase64Len is the length of the shortest base64 record, one without any
+// arguments, excluding the prefix.
+const minBase64Len = 8
+
+var (
+	_ encoding.BinaryMarshaler   = Output{}
+	_ encoding.BinaryUnmarshaler = (*Output)(nil)
+)
+
+// MarshalBinary encodes the output in the binary format written by
+// ctlog_base64_fprintf before it is base64 encoded, see Base64Prefix.
+func (o Output) MarshalBinary() ([]byte, error) {
+	return appendBinary(nil, &o)
+}
+
+// UnmarshalBinary decodes a binary record, see Base64Prefix. It reuses the
+// capacity of the output's Args.
+func (o *Output) UnmarshalBinary(data []byte) (err error) {
+	r := binaryReader{data: data}
+	v := Output{Args: o.Args[:0]}
+	r.header(&v)
+	v.ModuleIndex = uint32(r.uvarint(32))
+	v.LineNumber = uint32(r.uvarint(32))
+
+	nArgs := r.uvarint(32)
+	if r.err == nil && nArgs > uint64(len(data)-r.pos)/2 {
+		// Every argument is at least two bytes
+		r.err = fmt.Errorf("record is truncated")
+	}
+	for i := 0; i < int(nArgs) && r.err == nil; i++ {
+		arg := Arg{Type: Type(r.byte())}
+		switch arg.Type {
+		case TypeBool:
+			arg.Value = r.byte() != 0
+		case TypeChar:
+			arg.Value = r.byte()
+		case TypeInt:
+			arg.Value = int32(r.varint())
+		case TypeString:
+			n := r.uvarint(32)
+			if r.err == nil && n > uint64(len(data)-r.pos) {
+				r.err = fmt.Errorf("record is truncated")
+				break
+			}
+			arg.Value = string(data[r.pos : r.pos+int(n)])
+			r.pos += int(n)
+		case TypeUint:
+			arg.Value = uint32(r.uvarint(32))
+		default:
+			r.err = fmt.Errorf("unsupported argument %d type %d", i, arg.Type)
+		}
+		v.Args = append(v.Args, arg)
+	}
+
+	if err = r.err; err != nil {
+		return
+	}
+	if r.pos < len(data) {
+		err = fmt.Errorf("%d unexpected bytes after the record", len(data)-r.pos)
+		return
+	}
+	*o = v
+	return
+}
+
+// appendBinary appends output in the binary format written by
+// ctlog_base64_fprintf before it is base64 encoded.
+func appendBinary(b []byte, output *Output) ([]byte, error) {
+	if err := checkOutput(output); err != nil {
+		return b, err
+	}
+
+	b = append(b, output.Version)
+	if output.Version >= Version1 {
+		b = binary.AppendUvarint(b, uint64(output.Component))
+	}
+	b = binary.AppendUvarint(b, uint64(output.Sequence))
+	b = append(b, byte(output.Level))
+	b = binary.AppendUvarint(b, uint64(output.ModuleIndex))
+	b = binary.AppendUvarint(b, uint64(output.LineNumber))
+	b = binary.AppendUvarint(b, uint64(len(output.Args)))
+
+	for i, arg := range output.Args {
+		b = append(b, byte(arg.Type))
+
+		var err error
+		switch arg.Type {
+		case TypeBool:
+			v, ok := arg.Value.(bool)
+			if !ok {
+				err = argTypeError(i, arg)
+			} else if v {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case TypeChar:
+			v, ok := arg.Value.(byte)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = append(b, v)
+		case TypeInt:
+			v, ok := arg.Value.(int32)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = binary.AppendVarint(b, int64(v))
+		case TypeString:
+			v, ok := arg.Value.(string)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		case TypeUint:
+			v, ok := arg.Value.(uint32)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = binary.AppendUvarint(b, uint64(v))
+		default:
+			err = fmt.Errorf("unsupported argument %d type %d", i, arg.Type)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// appendBase64 appends output in the format written by ctlog_base64_fprintf.
+func appendBase64(b []byte, output *Output) ([]byte, error) {
+	data, err := appendBinary(nil, output)
+	if err != nil {
+		return b, err
+	}
+
+	b = append(b, Base64Prefix)
+	n := len(b)
+	for i := base64.RawStdEncoding.EncodedLen(len(data)); i > 0; i-- {
+		b = append(b, 0)
+	}
+	base64.RawStdEncoding.Encode(b[n:], data)
+	return b, nil
+}
+
+// base64Len returns the length of the base64 text at the start of data,
+// including any padding, and the length of the text without it.
+func base64Len(data []byte) (n, text int) {
+	for n < len(data) && isBase64Char(data[n]) {
+		n++
+	}
+	text = n
+	for n < len(data) && n-text < 2 && data[n] == '=' {
+		n++
+	}
+	return
+}
+
+func isBase64Char(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '+' || c == '/'
+}
+
+// isBase64Record returns true if line starts with what looks like a base64
+// record. Only the start of the record is decoded, so text that happens to
+// follow a Base64Prefix, e.g. a path like "~/src", is only mistaken for a
+// record if it also has a supported version and a valid level.
+func isBase64Record(line []byte) bool {
+	if len(line) == 0 || line[0] != Base64Prefix {
+		return false
+	}
+	_, text := base64Len(line[1:])
+	if text < minBase64Len {
+		return false
+	}
+
+	// The header is at most 10 bytes, which is 16 base64 characters
+	src := line[1 : 1+text]
+	if len(src) > 16 {
+		src = src[:16]
+	}
+	var header [12]byte
+	n, err := base64.RawStdEncoding.Decode(header[:], src)
+	if err != nil {
+		return false
+	}
+	r := binaryReader{data: header[:n]}
+	r.header(new(Output))
+	return r.err == nil
+}
+
+// decodeBase64 decodes the base64 record at the start of data into output and
+// returns its length.
+func decodeBase64(data []byte, output *Output) (length int, err error) {
+	length, text := base64Len(data[1:])
+	length++
+
+	b := make([]byte, base64.RawStdEncoding.DecodedLen(text))
+	if _, err = base64.RawStdEncoding.Decode(b, data[1:1+text]); err != nil {
+		return
+	}
+	err = output.UnmarshalBinary(b)
+	return
+}
+
+// A binaryReader reads the fields of a binary record, the first error is
+// kept in err and following reads return zero.
+type binaryReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// header reads the fields before the module index into output.
+func (r *binaryReader) header(output *Output) {
+	output.Version = r.byte()
+	if r.err == nil && output.Version > MaxSupportedVersion {
+		r.err = fmt.Errorf("version 0x%02X exceeds max supported version 0x%02X", output.Version, MaxSupportedVersion)
+		return
+	}
+	if output.Version >= Version1 {
+		output.Component = uint32(r.uvarint(32))
+	}
+	output.Sequence = uint16(r.uvarint(16))
+	output.Level = Level(r.byte())
+	if r.err == nil {
+		r.err = output.Level.check()
+	}
+}
+
+func (r *binaryReader) byte() (c byte) {
+	if r.err != nil {
+		return
+	}
+	if r.pos >= len(r.data) {
+		r.err = fmt.Errorf("record is truncated")
+		return
+	}
+	c = r.data[r.pos]
+	r.pos++
+	return
+}
+
+func (r *binaryReader) uvarint(bitSize int) (x uint64) {
+	if r.err != nil {
+		return
+	}
+	x, n := binary.Uvarint(r.data[r.pos:])
+	switch {
+	case n == 0:
+		r.err = fmt.Errorf("record is truncated")
+	case n < 0:
+		r.err = fmt.Errorf("invalid varint")
+	case x > 1<<uint(bitSize)-1:
+		r.err = fmt.Errorf("value %d overflows uint%d", x, bitSize)
+	default:
+		r.pos += n
+	}
+	return
+}
+
+func (r *binaryReader) varint() (x int64) {
+	if r.err != nil {
+		return
+	}
+	x, n := binary.Varint(r.data[r.pos:])
+	switch {
+	case n == 0:
+		r.err = fmt.Errorf("record is truncated")
+	case n < 0:
+		r.err = fmt.Errorf("invalid varint")
+	case x < math.MinInt32 || x > math.MaxInt32:
+		r.err = fmt.Errorf("value %d overflows int32", x)
+	default:
+		r.pos += n
+	}
+	return
+}
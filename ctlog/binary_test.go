@@ -0,0 +1,91 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalBinary(t *testing.T) {
+	var cases = []struct {
+		Data []byte
+		Exp  Output
+		Err  bool
+	}{
+		{
+			Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x00},
+			Exp:  Output{Sequence: 5, Level: LevelInfo, ModuleIndex: 3, LineNumber: 42},
+		},
+		{
+			Data: []byte{0x01, 0xF0, 0xA2, 0x04, 0x00, 'W', 0xAC, 0x02, 0x01, 0x02, 0x02, 0x03, 0x03, 0x02, 'h', 'i'},
+			Exp: Output{Version: Version1, Component: 70000, Level: LevelWarn, ModuleIndex: 300, LineNumber: 1, Args: []Arg{
+				{Type: TypeInt, Value: int32(-2)},
+				{Type: TypeString, Value: "hi"},
+			}},
+		},
+		{Data: []byte{}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03}, Err: true},
+		{Data: []byte{0x02, 0x05, 'I', 0x03, 0x2A, 0x00}, Err: true},
+		{Data: []byte{0x00, 0x05, 'X', 0x03, 0x2A, 0x00}, Err: true},
+		{Data: []byte{0x00, 0x80, 0x80, 0x04, 'I', 0x03, 0x2A, 0x00}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x01, 0x09, 0x00}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x01, 0x02, 0x80, 0x80, 0x80, 0x80, 0x10}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x01, 0x03, 0x05, 'h', 'i'}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x64, 0x00, 0x01}, Err: true},
+		{Data: []byte{0x00, 0x05, 'I', 0x03, 0x2A, 0x00, 0x00}, Err: true},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		var output Output
+		err := output.UnmarshalBinary(tc.Data)
+		if tc.Err {
+			if err == nil {
+				t.Error("expected error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(output, tc.Exp) {
+			t.Errorf("expected %+v but got %+v", tc.Exp, output)
+		}
+
+		data, err := output.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(data, tc.Data) {
+			t.Errorf("expected % X but got % X", tc.Data, data)
+		}
+	}
+}
+
+func TestIsBase64Record(t *testing.T) {
+	var cases = []struct {
+		Line string
+		Exp  bool
+	}{
+		{Line: "~AABJAyoA", Exp: true},
+		{Line: "~AQcCRQABAA trailing", Exp: true},
+		{Line: "~AABJAyoAAA", Exp: true}, // Only the header is checked
+		{Line: "~AABJ", Exp: false},
+		{Line: "~/src/ctlog/decoder.go", Exp: false},
+		{Line: "~Approximately", Exp: false},
+		{Line: "AABJAyoA", Exp: false},
+		{Line: "", Exp: false},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		if actual := isBase64Record([]byte(tc.Line)); actual != tc.Exp {
+			t.Errorf("expected %t but got %t", tc.Exp, actual)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const cOutputMain = `#include "ctlog.h"
+
+CMODULE_DEFINE( main );
+
+int
+main( void )
+{
+    ctlog_setStream( stdout );
+    ctlog_fprintf( 'I', g_cmodule_index, 10, 2, CTLOG_TYPE_UINT( 5 ), CTLOG_TYPE_STRING( "idle" ) );
+    ctlog_json_fprintf( 'W', g_cmodule_index, 20, 1, CTLOG_TYPE_INT( -2 ) );
+    ctlog_base64_fprintf( 'E', g_cmodule_index, 30, 1, CTLOG_TYPE_BOOL( true ) );
+    return 0;
+}
+`
+
+// TestCOutput builds the C library and checks that each of its formats
+// decodes, e.g. that the $TL version is output as two hex digits. It's
+// skipped if there isn't a C compiler.
+func TestCOutput(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	src, err := filepath.Abs(filepath.Join("..", "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cmodule_indices.h": "#define CMODULE_INDEX_main  (7)\n",
+		"main.c":            cOutputMain,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cases = []struct {
+		Flags     []string
+		Version   uint8
+		Component uint32
+		Prefix    string
+	}{
+		{Version: Version0, Prefix: "$TL00,"},
+		{Flags: []string{"-DCTLOG_COMPONENT_ID=300"}, Version: Version1, Component: 300, Prefix: "$TL01,300,"},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		bin := filepath.Join(dir, "main")
+		args := append([]string{"-I" + dir, "-I" + src, "-o", bin}, tc.Flags...)
+		args = append(args, filepath.Join(dir, "main.c"), filepath.Join(src, "ctlog.c"))
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Fatalf("error building: %v\n%s", err, out)
+		}
+		out, err := exec.Command(bin).Output()
+		if err != nil {
+			t.Fatalf("error running: %v", err)
+		}
+		if !bytes.HasPrefix(out, []byte(tc.Prefix)) {
+			t.Errorf("expected output to start with %q but got %q", tc.Prefix, out)
+		}
+
+		exp := []Output{
+			{Sequence: 0, Level: LevelInfo, LineNumber: 10, Args: []Arg{{Type: TypeUint, Value: uint32(5)}, {Type: TypeString, Value: "idle"}}},
+			{Sequence: 1, Level: LevelWarn, LineNumber: 20, Args: []Arg{{Type: TypeInt, Value: int32(-2)}}},
+			{Sequence: 2, Level: LevelError, LineNumber: 30, Args: []Arg{{Type: TypeBool, Value: true}}},
+		}
+		encs := []Encoding{EncodingTL, EncodingJSON, EncodingBase64}
+
+		d := NewDecoder(bytes.NewReader(out))
+		for j := range exp {
+			exp[j].Version = tc.Version
+			exp[j].Component = tc.Component
+			exp[j].ModuleIndex = 7
+
+			rec, err := d.Next()
+			if err != nil {
+				t.Fatalf("record %d: unexpected error: %v", j, err)
+			}
+			if rec.Encoding != encs[j] {
+				t.Errorf("record %d: expected %s but got %s", j, encs[j], rec.Encoding)
+			}
+			if !reflect.DeepEqual(rec.Output, exp[j]) {
+				t.Errorf("record %d: expected %+v but got %+v", j, exp[j], rec.Output)
+			}
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// CacheVersion is the version of the cache file format. Caches with a different
+// version are discarded.
+const CacheVersion = 3
+
+// A Cache stores the lines found in each source file so that files which
+// haven't changed don't need to be scanned again. Entries are keyed by path and
+// are considered unchanged if the file's size and modification time match, or
+// failing that if the hash of its contents matches. A Cache is safe for
+// concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	macros  string
+	entries map[string]cacheEntry
+	used    map[string]bool
+}
+
+type cacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Hash    string `json:"hash"`
+	Lines   []Line `json:"lines"`
+}
+
+type cacheFile struct {
+	Version int                   `json:"version"`
+	Macros  string                `json:"macros"`
+	Files   map[string]cacheEntry `json:"files"`
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{
+		entries: make(map[string]cacheEntry),
+		used:    make(map[string]bool),
+	}
+}
+
+// ReadCache reads a cache previously written by Encode. A cache written by a
+// different version is discarded rather than returning an error.
+func ReadCache(r io.Reader) (c *Cache, err error) {
+	var f cacheFile
+	if err = json.NewDecoder(r).Decode(&f); err != nil {
+		err = fmt.Errorf("error decoding cache: %v", err)
+		return
+	}
+
+	c = NewCache()
+	if f.Version == CacheVersion {
+		c.macros = f.Macros
+		for path, entry := range f.Files {
+			c.entries[path] = entry
+		}
+	}
+	return
+}
+
+// Encode writes the cache to w. Only entries used since the cache was read are
+// written, so files that no longer exist are pruned.
+func (c *Cache) Encode(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := cacheFile{
+		Version: CacheVersion,
+		Macros:  c.macros,
+		Files:   make(map[string]cacheEntry),
+	}
+	for path := range c.used {
+		f.Files[path] = c.entries[path]
+	}
+	return json.NewEncoder(w).Encode(&f)
+}
+
+// setMacros discards all entries if the cache was built using different macros.
+func (c *Cache) setMacros(specs []MacroSpec) {
+	data, _ := json.Marshal(specs)
+	sum := sha256.Sum256(data)
+	macros := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.macros != macros {
+		c.macros = macros
+		c.entries = make(map[string]cacheEntry)
+	}
+}
+
+func (c *Cache) get(path string) (entry cacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok = c.entries[path]
+	if ok {
+		c.used[path] = true
+	}
+	return
+}
+
+func (c *Cache) put(path string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[path] = entry
+	c.used[path] = true
+}
+
+// A SourceFile is a module's source file whose lines should be found.
+type SourceFile struct {
+	// Index and Name are the index and name of the module.
+	Index int
+	Name  string
+
+	// Path is the path to the module's source file.
+	Path string
+
+	// Data is the contents of the source file. If nil it's read from Path
+	// when needed.
+	Data []byte
+
+	// Info is the source file's info from before Data was read. It's used to
+	// check whether the file changed since it was cached, so if it's nil when
+	// there's a cache Data is ignored and the file is read again after it's
+	// stat. Otherwise a file changed between being read and stat would have
+	// its old lines cached as its new contents.
+	Info os.FileInfo
+}
+
+// FindModules finds the lines of each source, scanning files in parallel. If
+// cache is not nil it's used to skip files that haven't changed, and is updated
+// with any files that have. The modules are returned in the same order as the
+// sources.
+func (x *Extractor) FindModules(sources []SourceFile, cache *Cache) (modules []Module, err error) {
+	if cache != nil {
+		specs := x.Macros
+		if len(specs) == 0 {
+			specs = DefaultMacroSpecs
+		}
+		cache.setMacros(specs)
+	}
+
+	workers := x.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		idxs = make(chan int)
+		errs = make([]error, len(sources))
+	)
+	modules = make([]Module, len(sources))
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxs {
+				src := sources[i]
+				lines, err := x.findSourceLines(src, cache)
+				if err != nil {
+					errs[i] = fmt.Errorf("error finding module lines in %s: %v", src.Path, err)
+					continue
+				}
+				modules[i] = Module{
+					Index: src.Index,
+					Name:  src.Name,
+					Path:  src.Path,
+					Lines: lines,
+				}
+			}
+		}()
+	}
+	for i := range sources {
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+
+	for _, err = range errs {
+		if err != nil {
+			modules = nil
+			return
+		}
+	}
+	return
+}
+
+func (x *Extractor) findSourceLines(src SourceFile, cache *Cache) (lines []Line, err error) {
+	path := src.Path
+	if cache == nil {
+		if src.Data == nil {
+			src.Data, err = ioutil.ReadFile(path)
+			if err != nil {
+				return
+			}
+		}
+		return x.FindLines(bytes.NewReader(src.Data))
+	}
+
+	info := src.Info
+	if info == nil {
+		if info, err = os.Stat(path); err != nil {
+			return
+		}
+		src.Data = nil
+	}
+
+	entry, ok := cache.get(path)
+	if ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+		lines = entry.Lines
+		return
+	}
+
+	if src.Data == nil {
+		src.Data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+	}
+	sum := sha256.Sum256(src.Data)
+	hash := hex.EncodeToString(sum[:])
+
+	if !ok || entry.Hash != hash {
+		lines, err = x.FindLines(bytes.NewReader(src.Data))
+		if err != nil {
+			return
+		}
+		entry.Lines = lines
+	}
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime().UnixNano()
+	entry.Hash = hash
+	cache.put(path, entry)
+
+	lines = entry.Lines
+	return
+}
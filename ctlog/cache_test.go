@@ -0,0 +1,191 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindModulesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var sources []SourceFile
+	for i := 0; i < 8; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("module_%d.c", i))
+		src := fmt.Sprintf("CMODULE_DEFINE( module_%d );\nCTLOG_INFO( \"module %d\" );\n", i, i)
+		if err := ioutil.WriteFile(path, []byte(src), 0664); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, SourceFile{
+			Index: i,
+			Name:  fmt.Sprintf("module_%d", i),
+			Path:  path,
+		})
+	}
+
+	encode := func(modules []Module) []byte {
+		data, err := json.Marshal(modules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	x := Extractor{Workers: 3}
+	full, err := x.FindModules(sources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, module := range full {
+		if module.Index != i || len(module.Lines) != 1 || module.Lines[0].FormatString != fmt.Sprintf("module %d", i) {
+			t.Fatalf("unexpected module %+v", module)
+		}
+	}
+
+	// Populate the cache, then round-trip it through its encoding
+	cache := NewCache()
+	if _, err := x.FindModules(sources, cache); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cache.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = ReadCache(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.entries) != len(sources) {
+		t.Fatalf("expected %d cache entries but got %d", len(sources), len(cache.entries))
+	}
+
+	cached, err := x.FindModules(sources, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encode(cached), encode(full)) {
+		t.Error("cached output differs from full output")
+	}
+
+	// Change one file, its cached lines must not be used
+	path := sources[2].Path
+	if err := ioutil.WriteFile(path, []byte("CMODULE_DEFINE( module_2 );\n\nCTLOG_WARN( \"changed\" );\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err = x.FindModules(sources, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err = x.FindModules(sources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encode(cached), encode(full)) {
+		t.Error("cached output differs from full output after change")
+	}
+	exp := []Line{{Number: 3, Level: LevelWarn, FormatString: "changed"}}
+	if !reflect.DeepEqual(cached[2].Lines, exp) {
+		t.Errorf("expected %+v but got %+v", exp, cached[2].Lines)
+	}
+
+	// Different macros invalidate the cache
+	y := Extractor{Macros: []MacroSpec{{Name: "CTLOG_WARN", CountArg: -1}}}
+	modules, err := y.FindModules(sources, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules[0].Lines) != 0 {
+		t.Errorf("expected stale cache entries to be discarded but got %+v", modules[0].Lines)
+	}
+}
+
+func TestFindModulesCacheChangedAfterRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "main.c")
+	old := []byte("CMODULE_DEFINE( main );\nCTLOG_INFO( \"old\" );\n")
+	if err := ioutil.WriteFile(path, old, 0664); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file changes after it was read and stat, but before its lines are
+	// found
+	if err := ioutil.WriteFile(path, []byte("CMODULE_DEFINE( main );\n\nCTLOG_INFO( \"new\" );\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		Source SourceFile
+		Exp    string
+	}{
+		{
+			// The old lines are cached with the old info
+			Source: SourceFile{Name: "main", Path: path, Data: old, Info: info},
+			Exp:    "old",
+		},
+		{
+			// Without info the data can't be trusted and the file is read
+			Source: SourceFile{Name: "main", Path: path, Data: old},
+			Exp:    "new",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		var x Extractor
+		cache := NewCache()
+		if _, err := x.FindModules([]SourceFile{tc.Source}, cache); err != nil {
+			t.Fatal(err)
+		}
+
+		// The cache must not serve the lines found for the data as the
+		// file's current contents
+		modules, err := x.FindModules([]SourceFile{{Name: "main", Path: path}}, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := modules[0].Lines; len(lines) != 1 || lines[0].FormatString != "new" {
+			t.Errorf("expected the new line but got %+v", lines)
+		}
+
+		first, err := x.FindModules([]SourceFile{tc.Source}, NewCache())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := first[0].Lines; len(lines) != 1 || lines[0].FormatString != tc.Exp {
+			t.Errorf("expected %q but got %+v", tc.Exp, lines)
+		}
+	}
+}
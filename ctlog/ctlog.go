@@ -9,12 +9,16 @@ package ctlog
 
 import (
 	"bufio"
+	"bytes"
 	"encoding"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/jlubawy/go-ctext/cmacro"
 )
@@ -28,10 +32,39 @@ const (
 	LevelWarn  Level = 'W'
 )
 
-var _ encoding.TextUnmarshaler = (*Level)(nil)
+var (
+	_ encoding.TextMarshaler   = Level(0)
+	_ encoding.TextUnmarshaler = (*Level)(nil)
+)
+
+// MarshalText returns the level's character, or nothing for the zero level
+// of a line that isn't tokenized.
+func (lvl Level) MarshalText() (data []byte, err error) {
+	switch lvl {
+	case 0:
+		data = []byte{}
+	case LevelDebug, LevelError, LevelInfo, LevelWarn:
+		data = []byte{byte(lvl)}
+	default:
+		err = lvl.check()
+	}
+	return
+}
+
+// check returns an error if lvl isn't one of the levels output by ctlog.h.
+func (lvl Level) check() (err error) {
+	switch lvl {
+	case LevelDebug, LevelError, LevelInfo, LevelWarn:
+	default:
+		err = fmt.Errorf("unsupported level 0x%02X", byte(lvl))
+	}
+	return
+}
 
 func (lvl *Level) UnmarshalText(data []byte) (err error) {
-	if len(data) == 1 {
+	if len(data) == 0 {
+		*lvl = 0
+	} else if len(data) == 1 {
 		switch data[0] {
 		case 'D':
 			*lvl = LevelDebug
@@ -50,15 +83,98 @@ func (lvl *Level) UnmarshalText(data []byte) (err error) {
 	return
 }
 
-var MacroFuncNames = []string{
-	"CTLOG_ERROR",
-	"CTLOG_VAR_ERROR",
-	"CTLOG_INFO",
-	"CTLOG_VAR_INFO",
-	"CTLOG_DEBUG",
-	"CTLOG_VAR_DEBUG",
-	"CTLOG_WARN",
-	"CTLOG_VAR_WARN",
+// A MacroSpec describes a tokenized logging macro and the position of its
+// arguments.
+type MacroSpec struct {
+	// Name is the name of the macro.
+	Name string `json:"name"`
+
+	// FormatArg is the index of the format string argument.
+	FormatArg int `json:"formatArg"`
+
+	// CountArg is the index of the argument count argument, or -1 if the macro
+	// doesn't take any variable arguments. The variable arguments are expected
+	// to follow the count argument. It's -1 if omitted from JSON.
+	CountArg int `json:"countArg"`
+
+	// Level is the logging level of the macro, or zero if it isn't known.
+	Level Level `json:"level,omitempty"`
+}
+
+func (spec *MacroSpec) UnmarshalJSON(data []byte) (err error) {
+	type macroSpec MacroSpec
+	v := macroSpec{CountArg: -1}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return
+	}
+	*spec = MacroSpec(v)
+	return
+}
+
+// DefaultMacroSpecs are the logging macros defined by ctlog.h.
+var DefaultMacroSpecs = []MacroSpec{
+	{Name: "CTLOG_ERROR", FormatArg: 0, CountArg: -1, Level: LevelError},
+	{Name: "CTLOG_VAR_ERROR", FormatArg: 0, CountArg: 1, Level: LevelError},
+	{Name: "CTLOG_INFO", FormatArg: 0, CountArg: -1, Level: LevelInfo},
+	{Name: "CTLOG_VAR_INFO", FormatArg: 0, CountArg: 1, Level: LevelInfo},
+	{Name: "CTLOG_DEBUG", FormatArg: 0, CountArg: -1, Level: LevelDebug},
+	{Name: "CTLOG_VAR_DEBUG", FormatArg: 0, CountArg: 1, Level: LevelDebug},
+	{Name: "CTLOG_WARN", FormatArg: 0, CountArg: -1, Level: LevelWarn},
+	{Name: "CTLOG_VAR_WARN", FormatArg: 0, CountArg: 1, Level: LevelWarn},
+}
+
+// MacroFuncNames are the names of the logging macros defined by ctlog.h.
+//
+// Deprecated: Use DefaultMacroSpecs.
+var MacroFuncNames = macroNames(DefaultMacroSpecs)
+
+func macroNames(specs []MacroSpec) []string {
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Name
+	}
+	return names
+}
+
+// ParseMacroSpec parses a macro spec of the form 'NAME:FORMAT:COUNT:LEVEL',
+// where FORMAT and COUNT are argument indices and LEVEL is one of D, E, I or W.
+// COUNT may be empty or -1 if the macro doesn't take variable arguments and
+// LEVEL may be omitted if it isn't known.
+func ParseMacroSpec(s string) (spec MacroSpec, err error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 || len(fields) > 4 {
+		err = fmt.Errorf("invalid macro spec '%s', expected NAME:FORMAT:COUNT:LEVEL", s)
+		return
+	}
+
+	spec.Name = fields[0]
+	if spec.Name == "" {
+		err = fmt.Errorf("invalid macro spec '%s', missing name", s)
+		return
+	}
+
+	spec.FormatArg, err = strconv.Atoi(fields[1])
+	if err != nil || spec.FormatArg < 0 {
+		err = fmt.Errorf("invalid macro spec '%s', bad format argument index", s)
+		return
+	}
+
+	spec.CountArg = -1
+	if len(fields) > 2 && fields[2] != "" {
+		spec.CountArg, err = strconv.Atoi(fields[2])
+		if err != nil || spec.CountArg < -1 {
+			err = fmt.Errorf("invalid macro spec '%s', bad count argument index", s)
+			return
+		}
+	}
+
+	if len(fields) > 3 && fields[3] != "" {
+		if err = spec.Level.UnmarshalText([]byte(fields[3])); err != nil {
+			err = fmt.Errorf("invalid macro spec '%s', %v", s, err)
+			return
+		}
+	}
+	return
 }
 
 type Type int
@@ -71,6 +187,38 @@ const (
 	TypeUint   Type = 0x04
 )
 
+// A Dictionary is a tokenized logging dictionary, it contains the format
+// strings of every tokenized logging line in a project.
+type Dictionary struct {
+	Date time.Time `json:"date"`
+
+	// BuildID is the fingerprint of the dictionary, see Fingerprint.
+	BuildID string `json:"buildId,omitempty"`
+
+	// LineConvention is the line that __LINE__ refers to in a macro
+	// invocation spanning multiple lines for the compiler used.
+	LineConvention LineConvention `json:"lineConvention,omitempty"`
+
+	Modules []Module `json:"modules"`
+
+	// Components are the dictionaries of each firmware component sharing an
+	// output, see MergeDictionaries.
+	Components []Component `json:"components,omitempty"`
+}
+
+// A Component is the dictionary of one of several firmware components whose
+// output is multiplexed together, e.g. multiple MCUs sharing a debug UART.
+// Each component is built with its own CTLOG_COMPONENT_ID.
+type Component struct {
+	// ID is the component ID included in the component's output.
+	ID uint32 `json:"id"`
+
+	// BuildID is the build ID of the component's dictionary.
+	BuildID string `json:"buildId,omitempty"`
+
+	Modules []Module `json:"modules"`
+}
+
 type Module struct {
 	// Index is the index in the sorted module slice.
 	Index int `json:"index"`
@@ -85,38 +233,228 @@ type Module struct {
 }
 
 type Line struct {
-	// Number is the line number of the tokenized logging output.
+	// Number is the line number of the tokenized logging output. For a macro
+	// invocation spanning multiple lines it's the line of the closing
+	// parenthesis.
 	Number int `json:"number"`
 
+	// Start is the first line of a macro invocation spanning multiple lines,
+	// or zero if it's on a single line.
+	Start int `json:"start,omitempty"`
+
+	// Level is the logging level of the macro used, if it's known.
+	Level Level `json:"level,omitempty"`
+
 	// FormatString is the format string that should be used for formatting the
 	// tokenized logging variable output.
 	FormatString string `json:"formatString"`
 }
 
-// FindLines finds all tokenized logging lines within the given io.Reader.
+// Output returns the line number the line outputs when compiled by a compiler
+// using the line convention.
+func (l Line) Output(lc LineConvention) int {
+	if lc == LineStart && l.Start != 0 {
+		return l.Start
+	}
+	return l.Number
+}
+
+// A LineConvention is the line a compiler uses for __LINE__ within a macro
+// invocation spanning multiple lines. Compilers and even versions of the same
+// compiler disagree, e.g. older GCC versions use the last line while newer
+// versions and Clang use the first.
+type LineConvention string
+
+const (
+	// LineEnd uses the line of the closing parenthesis. It's the default.
+	LineEnd LineConvention = "end"
+
+	// LineStart uses the line of the macro name.
+	LineStart LineConvention = "start"
+)
+
+// orDefault returns the line convention, or LineEnd if it's empty.
+func (c LineConvention) orDefault() LineConvention {
+	if c == "" {
+		return LineEnd
+	}
+	return c
+}
+
+func (c *LineConvention) UnmarshalText(data []byte) (err error) {
+	switch lc := LineConvention(data); lc {
+	case "", LineEnd, LineStart:
+		*c = lc
+	default:
+		err = fmt.Errorf("unsupported line convention '%s'", string(data))
+	}
+	return
+}
+
+// FindLines finds all tokenized logging lines within the given io.Reader using
+// the DefaultMacroSpecs.
 func FindLines(r io.Reader) (lines []Line, err error) {
+	return new(Extractor).FindLines(r)
+}
+
+// An Extractor finds tokenized logging lines within C source files.
+type Extractor struct {
+	// Macros are the logging macros to search for. If empty DefaultMacroSpecs
+	// is used.
+	Macros []MacroSpec
+
+	// Workers is the number of files scanned in parallel by FindModules. If
+	// zero the number of CPUs is used.
+	Workers int
+}
+
+// FindLines finds all tokenized logging lines within the given io.Reader.
+func (x *Extractor) FindLines(r io.Reader) (lines []Line, err error) {
 	lines = make([]Line, 0)
 
+	specs := x.Macros
+	if len(specs) == 0 {
+		specs = DefaultMacroSpecs
+	}
+
+	var (
+		names   = macroNames(specs)
+		byName  = make(map[string]MacroSpec)
+		seen    = make(map[Line]bool)
+		scanErr error
+	)
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+
 	err = cmacro.ScanInvocations(r, func(inv cmacro.Invocation) {
-		rs := inv.Args[0]
-		if rs[0] != '"' {
-			err = fmt.Errorf("format string missing opening quote")
+		if scanErr != nil {
 			return
 		}
-		if rs[len(rs)-1] != '"' {
-			err = fmt.Errorf("format string missing closing quote")
+
+		var line Line
+		line, scanErr = newLine(byName[inv.Name], inv)
+		if scanErr != nil {
+			scanErr = fmt.Errorf("line %d: %s: %v", inv.End, inv.Name, scanErr)
 			return
 		}
 
-		lines = append(lines, Line{
-			Number:       inv.End,
-			FormatString: rs[1 : len(rs)-1],
-		})
-	}, MacroFuncNames...)
+		if inv.Start != inv.End {
+			line.Start = inv.Start
+		}
+
+		// Identical calls, e.g. from a macro expanding to the same call
+		// twice, decode the same way so only one is kept. Calls that share
+		// a token but decode differently are all kept, see
+		// Dictionary.Collisions.
+		if seen[line] {
+			return
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	}, names...)
 	if err != nil {
 		return
 	}
+	err = scanErr
+	return
+}
 
+// A CollisionError describes two logging calls that output the same token but
+// decode differently. Output with the token can't be translated.
+type CollisionError struct {
+	// Module is the name of the module containing the calls.
+	Module string
+
+	// Number is the line number output by both calls.
+	Number int
+
+	Lines [2]Line
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%s: line %d: %q and %q share a token, move one of them to its own line",
+		e.Module, e.Number, e.Lines[0].FormatString, e.Lines[1].FormatString)
+}
+
+// Collisions returns the lines of the dictionary's modules that output the
+// same token, using the dictionary's line convention, but decode differently.
+func (d *Dictionary) Collisions() (collisions []*CollisionError) {
+	for _, module := range d.Modules {
+		byNumber := make(map[int]Line)
+		for _, line := range module.Lines {
+			number := line.Output(d.LineConvention)
+			other, ok := byNumber[number]
+			if !ok {
+				byNumber[number] = line
+				continue
+			}
+			if other.FormatString != line.FormatString || other.Level != line.Level {
+				collisions = append(collisions, &CollisionError{
+					Module: module.Name,
+					Number: number,
+					Lines:  [2]Line{other, line},
+				})
+			}
+		}
+	}
+	return
+}
+
+func newLine(spec MacroSpec, inv cmacro.Invocation) (line Line, err error) {
+	if spec.FormatArg >= len(inv.Args) {
+		err = fmt.Errorf("missing format string argument %d", spec.FormatArg)
+		return
+	}
+
+	rs := inv.Args[spec.FormatArg]
+	if len(rs) == 0 || rs[0] != '"' {
+		err = fmt.Errorf("format string missing opening quote")
+		return
+	}
+	if len(rs) < 2 || rs[len(rs)-1] != '"' {
+		err = fmt.Errorf("format string missing closing quote")
+		return
+	}
+
+	if spec.CountArg >= 0 {
+		if spec.CountArg >= len(inv.Args) {
+			err = fmt.Errorf("missing argument count argument %d", spec.CountArg)
+			return
+		}
+
+		// Only check the count if it's a literal, it could be a macro or
+		// expression that we can't evaluate
+		if n, err1 := strconv.Atoi(inv.Args[spec.CountArg]); err1 == nil {
+			if nArgs := countArgs(inv.Args[spec.CountArg+1:]); n != nArgs {
+				err = fmt.Errorf("argument count %d doesn't match the %d arguments provided", n, nArgs)
+				return
+			}
+		}
+	}
+
+	line = Line{
+		Number:       inv.End,
+		Level:        spec.Level,
+		FormatString: rs[1 : len(rs)-1],
+	}
+	return
+}
+
+// countArgs returns the number of logged arguments in the variable arguments
+// of a logging macro. Each is either a type macro like CTLOG_TYPE_UINT( x ) or
+// a type constant like CTLOG_TYPE_N_UINT followed by its value, and a single
+// NULL is used when there aren't any.
+func countArgs(args []string) (n int) {
+	if len(args) == 1 && args[0] == "NULL" {
+		return 0
+	}
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "CTLOG_TYPE_N_") {
+			i++
+		}
+		n++
+	}
 	return
 }
 
@@ -124,7 +462,8 @@ const MagicString = "$TL"
 
 const (
 	Version0            = uint8(0x00)
-	MaxSupportedVersion = Version0
+	Version1            = uint8(0x01) // adds the component ID
+	MaxSupportedVersion = Version1
 )
 
 // HasTlogLine returns true if the provided byte slice might contain a tokenized
@@ -132,12 +471,12 @@ const (
 func HasTlogLine(data []byte) (ok bool, err error) {
 	if len(data) >= 6 {
 		if string(data[0:3]) == MagicString && data[5] == ',' {
-			var n uint64
-			n, err = strconv.ParseUint(string(data[3:5]), 16, 8)
+			var n uint8
+			n, err = parseVersion(data[3:5])
 			if err != nil {
 				return
 			}
-			if uint8(n) > MaxSupportedVersion {
+			if n > MaxSupportedVersion {
 				err = fmt.Errorf("version 0x%02X exceeds max supported version 0x%02X", n, MaxSupportedVersion)
 				return
 			}
@@ -155,7 +494,8 @@ func NewScanner(r io.Reader) (s *bufio.Scanner) {
 }
 
 // ScanLines is like bufio.ScanLines except that it takes into account that there
-// might be \r or \n characters inside tokenized log string literals.
+// might be \r or \n characters inside tokenized log string literals, including
+// those of a tokenized log line that follows other text on the same line.
 func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	var (
 		inTlogLine bool
@@ -183,20 +523,11 @@ func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 
 		case '$':
 			if !inTlogLine && !inTlogStr {
-				if i > 0 {
-					// If we see a $ char that isn't at the beginning of a line then
-					// return the existing data
-					advance = i
-					token = data[0:i]
-					return
-				}
-
-				// Else this could be the start of a tlog line so find
-				// the start and version if there is one
-				inTlogLine, err = HasTlogLine(data)
-				if err != nil {
-					return
-				}
+				// This could be the start of a tlog line, which may follow
+				// other text, so find the start and version if there is
+				// one. Lines with an unsupported version are split like any
+				// other line and left for the parser to report.
+				inTlogLine, _ = HasTlogLine(data[i:])
 			}
 
 		case '\x00':
@@ -212,17 +543,23 @@ func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		}
 	}
 
-	if atEOF {
-		// If at the EOF return the current data, if any
-		advance = len(data) + 1
-		token = data[0:]
-		err = io.EOF
+	if atEOF && len(data) > 0 {
+		// If at the EOF return the remaining data as the last line
+		advance = len(data)
+		token = data
 	}
 
 	return
 }
 
 type Output struct {
+	// Version is the version of the output format, see MaxSupportedVersion.
+	Version uint8 `json:"ctlog"`
+
+	// Component is the ID of the firmware component that output this line, or
+	// zero if it wasn't built with a component ID.
+	Component uint32 `json:"cid,omitempty"`
+
 	// Sequence is the current log lines sequence number. It is useful for
 	// determining if lines have been dropped.
 	Sequence uint16 `json:"seq"`
@@ -240,6 +577,36 @@ type Output struct {
 	Args []Arg `json:"args"`
 }
 
+var (
+	_ json.Marshaler   = Output{}
+	_ json.Unmarshaler = (*Output)(nil)
+	_ json.Marshaler   = Arg{}
+	_ json.Unmarshaler = (*Arg)(nil)
+)
+
+// MarshalJSON encodes the output the same way as ctlog_json_fprintf, except
+// that bytes that aren't valid UTF-8 are escaped so they decode to the same
+// value, and the zero level of a text record is encoded as "".
+func (o Output) MarshalJSON() ([]byte, error) {
+	return appendJSON(nil, &o, false)
+}
+
+func (o *Output) UnmarshalJSON(data []byte) (err error) {
+	// Decode using a type without methods to avoid recursing, keeping the
+	// capacity of the existing Args
+	type output Output
+	v := output{Args: o.Args[:0]}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return
+	}
+	if v.Version > MaxSupportedVersion {
+		err = fmt.Errorf("version 0x%02X exceeds max supported version 0x%02X", v.Version, MaxSupportedVersion)
+		return
+	}
+	*o = Output(v)
+	return
+}
+
 func (o *Output) Vals() []interface{} {
 	vs := make([]interface{}, len(o.Args))
 	for i := 0; i < len(vs); i++ {
@@ -253,55 +620,137 @@ type Arg struct {
 	Value interface{} `json:"v"`
 }
 
+// MarshalJSON encodes the argument the same way as ctlog_json_fprintf, except
+// that bytes that aren't valid UTF-8 are escaped so they decode to the same
+// value.
+func (a Arg) MarshalJSON() ([]byte, error) {
+	return appendJSONArg(nil, 0, a, false)
+}
+
 func (a *Arg) UnmarshalJSON(data []byte) (err error) {
 	var v struct {
-		Type  Type        `json:"t"`
-		Value interface{} `json:"v"`
+		Type  Type            `json:"t"`
+		Value json.RawMessage `json:"v"`
 	}
 	err = json.Unmarshal(data, &v)
 	if err != nil {
 		return
 	}
 
+	var value interface{}
 	switch v.Type {
 	case TypeBool:
-		x, ok := v.Value.(bool)
-		if ok {
-			v.Value = x
-		}
+		var x bool
+		err = json.Unmarshal(v.Value, &x)
+		value = x
 	case TypeChar:
-		x, ok := v.Value.(string)
-		if ok {
-			if len(x) == 0 {
-				err = fmt.Errorf("empty character found")
-				return
-			}
-			v.Value = x[0]
+		var x string
+		if x, err = unquoteJSON(v.Value); err != nil {
+			break
 		}
-	case TypeInt:
-		x, ok := v.Value.(float64)
-		if ok {
-			v.Value = int32(x)
+		if len(x) == 0 {
+			err = fmt.Errorf("empty character found")
+			break
+		}
+		// A character that isn't ASCII is either a raw byte written by the C
+		// code or escaped as a single byte, but may be UTF-8 from elsewhere
+		if r, size := utf8.DecodeRuneInString(x); r < 0x100 && size == len(x) {
+			value = byte(r)
+		} else {
+			value = x[0]
 		}
+	case TypeInt:
+		var x int32
+		err = json.Unmarshal(v.Value, &x)
+		value = x
 	case TypeString:
-		// string doesn't require casting
+		var x string
+		x, err = unquoteJSON(v.Value)
+		value = x
 	case TypeUint:
-		x, ok := v.Value.(float64)
-		if ok {
-			v.Value = uint32(x)
-		}
+		var x uint32
+		err = json.Unmarshal(v.Value, &x)
+		value = x
 	default:
 		err = fmt.Errorf("unsupported type %d", v.Type)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("error decoding type %d value: %v", v.Type, err)
+		return
 	}
 	a.Type = v.Type
-	a.Value = v.Value
+	a.Value = value
+	return
+}
+
+// unquoteJSON decodes a JSON string argument. Unlike json.Unmarshal, bytes
+// that aren't valid UTF-8 are kept as is, like the C code writes them, and
+// \u0080 to \u00FF are decoded as the single bytes that MarshalJSON escapes.
+func unquoteJSON(data []byte) (s string, err error) {
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		err = fmt.Errorf("expected a string but got %s", data)
+		return
+	}
+	data = data[1 : len(data)-1]
+	if bytes.IndexByte(data, '\\') == -1 {
+		s = string(data)
+		return
+	}
+
+	// The escapes are complete since json.Unmarshal checked the JSON is valid
+	b := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			b = append(b, data[i])
+			continue
+		}
+		i++
+		switch data[i] {
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r := hexRune(data[i+1 : i+5])
+			i += 4
+			if utf16.IsSurrogate(r) && i+6 < len(data) && data[i+1] == '\\' && data[i+2] == 'u' {
+				if r2 := utf16.DecodeRune(r, hexRune(data[i+3:i+7])); r2 != utf8.RuneError {
+					r = r2
+					i += 6
+				}
+			}
+			if r >= 0x80 && r <= 0xFF {
+				b = append(b, byte(r))
+			} else {
+				var buf [utf8.UTFMax]byte
+				b = append(b, buf[:utf8.EncodeRune(buf[:], r)]...)
+			}
+		default:
+			b = append(b, data[i])
+		}
+	}
+	s = string(b)
 	return
 }
 
+// hexRune parses the 4 hex digits of a \u escape.
+func hexRune(data []byte) rune {
+	n, _ := strconv.ParseUint(string(data), 16, 16)
+	return rune(n)
+}
+
 type state int
 
 const (
 	psInit state = iota
+	psComponent
 	psSeq
 	psLevel
 	psModuleIdx
@@ -311,13 +760,39 @@ const (
 	psVal
 )
 
+// ParseOutput parses a tokenized logging line into a new Output. ok is false
+// if data isn't a tokenized logging line.
 func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 	output = new(Output)
+	ok, err = ParseOutputInto(data, output)
+	return
+}
+
+var (
+	strStart = []byte("^\x00")
+	strEnd   = []byte("$\x00")
+)
+
+// ParseOutputInto is like ParseOutput except it parses into the provided
+// Output, reusing the capacity of its Args. It doesn't allocate other than to
+// copy string arguments and to store argument values that don't fit in an
+// interface without allocating.
+func ParseOutputInto(data []byte, output *Output) (ok bool, err error) {
+	_, ok, err = parseOutput(data, output)
+	return
+}
+
+// parseOutput is ParseOutputInto that also returns the length of the
+// tokenized logging record at the start of data, which may be followed by
+// other text.
+func parseOutput(data []byte, output *Output) (length int, ok bool, err error) {
+	*output = Output{Args: output.Args[:0]}
 
 	var (
 		s     state
 		nArgs int
 		iArg  int
+		size  = len(data)
 	)
 
 	for {
@@ -334,17 +809,43 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 				err = fmt.Errorf("missing data after magic string")
 				return
 			}
+			version, _ := parseVersion(data[3:5])
+			output.Version = version
 			data = data[6:]
+			if version >= Version1 {
+				s = psComponent
+			} else {
+				s = psSeq
+			}
+
+		case psComponent:
+			ci := bytes.IndexByte(data, ',')
+			if ci == -1 {
+				err = fmt.Errorf("expected component ID comma but found none")
+				return
+			}
+			var n uint64
+			n, err = parseUint(data[0:ci], 32)
+			if err != nil {
+				err = fmt.Errorf("error parsing component ID: %v", err)
+				return
+			}
+			output.Component = uint32(n)
+			if len(data) < ci+1 {
+				err = fmt.Errorf("missing data after component ID")
+				return
+			}
+			data = data[ci+1:]
 			s = psSeq
 
 		case psSeq:
-			ci := strings.IndexByte(string(data), ',')
+			ci := bytes.IndexByte(data, ',')
 			if ci == -1 {
 				err = fmt.Errorf("expected sequence number comma but found none")
 				return
 			}
 			var n uint64
-			n, err = strconv.ParseUint(string(data[0:ci]), 10, 16)
+			n, err = parseUint(data[0:ci], 16)
 			if err != nil {
 				err = fmt.Errorf("error parsing sequence number: %v", err)
 				return
@@ -358,6 +859,10 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 			s = psLevel
 
 		case psLevel:
+			if len(data) == 0 {
+				err = fmt.Errorf("missing logging level")
+				return
+			}
 			lvl := Level(data[0])
 			switch lvl {
 			case LevelDebug:
@@ -380,13 +885,13 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 			s = psModuleIdx
 
 		case psModuleIdx:
-			ci := strings.IndexByte(string(data), ',')
+			ci := bytes.IndexByte(data, ',')
 			if ci == -1 {
 				err = fmt.Errorf("expected module index comma but found none")
 				return
 			}
 			var n uint64
-			n, err = strconv.ParseUint(string(data[0:ci]), 10, 32)
+			n, err = parseUint(data[0:ci], 32)
 			if err != nil {
 				err = fmt.Errorf("error parsing module index: %v", err)
 				return
@@ -400,13 +905,13 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 			s = psLine
 
 		case psLine:
-			ci := strings.IndexByte(string(data), ',')
+			ci := bytes.IndexByte(data, ',')
 			if ci == -1 {
 				err = fmt.Errorf("expected line number comma but found none")
 				return
 			}
 			var n uint64
-			n, err = strconv.ParseUint(string(data[0:ci]), 10, 32)
+			n, err = parseUint(data[0:ci], 32)
 			if err != nil {
 				err = fmt.Errorf("error parsing line number: %v", err)
 				return
@@ -420,13 +925,13 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 			s = psNArgs
 
 		case psNArgs:
-			ci := strings.IndexByte(string(data), ',')
+			ci := bytes.IndexByte(data, ',')
 			if ci == -1 {
 				err = fmt.Errorf("expected argument count comma but found none")
 				return
 			}
 			var n uint64
-			n, err = strconv.ParseUint(string(data[0:ci]), 10, 8)
+			n, err = parseUint(data[0:ci], 8)
 			if err != nil {
 				err = fmt.Errorf("error parsing argument count: %v", err)
 				return
@@ -435,24 +940,29 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 
 			if nArgs == 0 {
 				// If no args then return
+				length = size - len(data) + ci + 1
 				return
 			}
 			if len(data) < ci+1 {
 				err = fmt.Errorf("missing data after argument count")
 				return
 			}
-			output.Args = make([]Arg, nArgs)
+			if cap(output.Args) >= nArgs {
+				output.Args = output.Args[:nArgs]
+			} else {
+				output.Args = make([]Arg, nArgs)
+			}
 			data = data[ci+1:]
 			s = psType
 
 		case psType:
-			ci := strings.IndexByte(string(data), ',')
+			ci := bytes.IndexByte(data, ',')
 			if ci == -1 {
 				err = fmt.Errorf("expected argument %d type comma but found none", iArg)
 				return
 			}
 			var n uint64
-			n, err = strconv.ParseUint(string(data[0:ci]), 10, 8)
+			n, err = parseUint(data[0:ci], 8)
 			if err != nil {
 				err = fmt.Errorf("error parsing argument %d type: %v", iArg, err)
 				return
@@ -470,11 +980,11 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 			t := output.Args[iArg].Type
 			if t == TypeString {
 				// If the argument type is string
-				if string(data[0:2]) != "^\x00" {
-					err = fmt.Errorf("missing start of argument %d string '% X'", iArg, data[0:2])
+				if !bytes.HasPrefix(data, strStart) {
+					err = fmt.Errorf("missing start of argument %d string", iArg)
 					return
 				}
-				end := strings.Index(string(data[0:]), "$\x00")
+				end := bytes.Index(data, strEnd)
 				if end == -1 {
 					err = fmt.Errorf("missing end of argument %d string", iArg)
 					return
@@ -489,7 +999,7 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 
 			} else {
 				// Else numerical arguments
-				ci := strings.IndexByte(string(data), ',')
+				ci := bytes.IndexByte(data, ',')
 				if ci == -1 {
 					err = fmt.Errorf("expected argument %d value comma but found none", iArg)
 					return
@@ -506,7 +1016,7 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 					} else { // if t == TypeUint {
 						size = 32
 					}
-					n, err = strconv.ParseUint(string(data[0:ci]), 10, size)
+					n, err = parseUint(data[0:ci], size)
 					if err != nil {
 						err = fmt.Errorf("error parsing argument %d value: %v", iArg, err)
 						return
@@ -519,7 +1029,7 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 
 				case TypeInt:
 					var n int64
-					n, err = strconv.ParseInt(string(data[0:ci]), 10, 32)
+					n, err = parseInt(data[0:ci], 32)
 					if err != nil {
 						err = fmt.Errorf("error parsing argument %d value: %v", iArg, err)
 						return
@@ -530,7 +1040,7 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 
 				case TypeBool:
 					var b bool
-					b, err = strconv.ParseBool(string(data[0:ci]))
+					b, err = parseBool(data[0:ci])
 					if err != nil {
 						err = fmt.Errorf("error parsing argument %d value: %v", iArg, err)
 						return
@@ -554,40 +1064,85 @@ func ParseOutput(data []byte) (output *Output, ok bool, err error) {
 
 			if iArg >= len(output.Args) {
 				// If done then return
+				length = size - len(data)
 				return
 			}
 		}
 	}
+}
 
+// parseVersion parses the two hex digit version of a tokenized logging line.
+func parseVersion(data []byte) (version uint8, err error) {
+	for _, c := range data {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			// Let strconv describe the error
+			_, err = strconv.ParseUint(string(data), 16, 8)
+			return
+		}
+		version = version<<4 | c
+	}
 	return
 }
 
-type Translator struct {
-	modules []Module
+// parseUint is like strconv.ParseUint in base 10 except that it doesn't
+// allocate unless there's an error.
+func parseUint(data []byte, bitSize int) (n uint64, err error) {
+	max := uint64(1)<<uint(bitSize) - 1
+	if len(data) == 0 || len(data) > 20 {
+		return strconv.ParseUint(string(data), 10, bitSize)
+	}
+	for _, c := range data {
+		if c < '0' || c > '9' {
+			return strconv.ParseUint(string(data), 10, bitSize)
+		}
+		d := uint64(c - '0')
+		if n > (max-d)/10 {
+			return strconv.ParseUint(string(data), 10, bitSize)
+		}
+		n = n*10 + d
+	}
+	return
 }
 
-func NewTranslator(modules []Module) *Translator {
-	return &Translator{
-		modules: modules,
+// parseInt is like strconv.ParseInt in base 10 except that it doesn't
+// allocate unless there's an error.
+func parseInt(data []byte, bitSize int) (n int64, err error) {
+	neg := len(data) > 0 && data[0] == '-'
+	digits := data
+	if len(data) > 0 && (data[0] == '-' || data[0] == '+') {
+		digits = data[1:]
 	}
-}
 
-func (t *Translator) Translate(output *Output) (s string, err error) {
-	// Find module first
-	if output.ModuleIndex >= uint32(len(t.modules)) {
-		err = fmt.Errorf("could not find module %d", output.ModuleIndex)
-		return
+	max := uint64(1) << uint(bitSize-1)
+	u, err := parseUint(digits, 64)
+	if err != nil || u > max || (!neg && u == max) {
+		return strconv.ParseInt(string(data), 10, bitSize)
+	}
+	if neg {
+		n = -int64(u)
+	} else {
+		n = int64(u)
 	}
-	module := t.modules[output.ModuleIndex]
+	return
+}
 
-	// Find the line within the module
-	for _, line := range module.Lines {
-		if line.Number == int(output.LineNumber) {
-			s = fmt.Sprintf(line.FormatString, output.Vals()...)
-			return
+// parseBool is like strconv.ParseBool except that it doesn't allocate unless
+// there's an error.
+func parseBool(data []byte) (b bool, err error) {
+	if len(data) == 1 {
+		switch data[0] {
+		case '0':
+			return false, nil
+		case '1':
+			return true, nil
 		}
 	}
-
-	err = fmt.Errorf("could not find line %d in module %d", output.LineNumber, output.ModuleIndex)
-	return
+	return strconv.ParseBool(string(data))
 }
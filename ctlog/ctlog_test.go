@@ -46,42 +46,52 @@ main( void )
 			Lines: []Line{
 				{
 					Number:       14,
+					Level:        LevelInfo,
 					FormatString: "%s",
 				},
 				{
 					Number:       15,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       16,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       17,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       18,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       19,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       20,
+					Level:        LevelInfo,
 					FormatString: "%d",
 				},
 				{
 					Number:       21,
+					Level:        LevelInfo,
 					FormatString: "%s",
 				},
 				{
 					Number:       22,
+					Level:        LevelInfo,
 					FormatString: "%t",
 				},
 				{
 					Number:       23,
+					Level:        LevelInfo,
 					FormatString: "%c",
 				},
 			},
@@ -104,6 +114,269 @@ main( void )
 	}
 }
 
+func TestExtractor(t *testing.T) {
+	var cases = []struct {
+		Macros    []MacroSpec
+		Input     string
+		Lines     []Line
+		ExpectErr bool
+	}{
+		{
+			Macros: []MacroSpec{
+				{Name: "APP_LOG", FormatArg: 1, CountArg: 2},
+				{Name: "RADIO_ERR", FormatArg: 0, CountArg: -1, Level: LevelError},
+			},
+			Input: `
+CMODULE_DEFINE( radio );
+
+void
+radio_init( void )
+{
+    APP_LOG( TAG_RADIO, "init channel=%d", 1, CTLOG_TYPE_UINT( 11 ) );
+    CTLOG_INFO( "not searched" );
+    RADIO_ERR( "init failed" );
+}
+`,
+			Lines: []Line{
+				{
+					Number:       7,
+					FormatString: "init channel=%d",
+				},
+				{
+					Number:       9,
+					Level:        LevelError,
+					FormatString: "init failed",
+				},
+			},
+		},
+		{
+			Macros: nil,
+			Input:  `CTLOG_VAR_INFO( "%d", 1, CTLOG_TYPE_N_INT, x );`,
+			Lines: []Line{
+				{
+					Number:       1,
+					Level:        LevelInfo,
+					FormatString: "%d",
+				},
+			},
+		},
+		{
+			Macros:    nil,
+			Input:     `CTLOG_VAR_INFO( "%d %d", 1, CTLOG_TYPE_UINT( 1 ), CTLOG_TYPE_UINT( 2 ) );`,
+			ExpectErr: true,
+		},
+		{
+			Macros: nil,
+			Input:  `CTLOG_VAR_INFO( "none", 0, NULL ); CTLOG_VAR_INFO( "%d", N_ARGS, CTLOG_TYPE_INT( 1 ), CTLOG_TYPE_INT( 2 ) );`,
+			Lines: []Line{
+				{
+					Number:       1,
+					Level:        LevelInfo,
+					FormatString: "none",
+				},
+				{
+					Number:       1,
+					Level:        LevelInfo,
+					FormatString: "%d",
+				},
+			},
+		},
+		{
+			Macros: []MacroSpec{
+				{Name: "APP_LOG", FormatArg: 1, CountArg: 2},
+			},
+			Input:     `APP_LOG( "missing tag" );`,
+			ExpectErr: true,
+		},
+		{
+			Macros: nil,
+			Input:  `CTLOG_INFO( "a" ); CTLOG_WARN( "a" );`,
+			Lines: []Line{
+				{
+					Number:       1,
+					Level:        LevelInfo,
+					FormatString: "a",
+				},
+				{
+					Number:       1,
+					Level:        LevelWarn,
+					FormatString: "a",
+				},
+			},
+		},
+		{
+			Macros: nil,
+			Input:  `CTLOG_INFO( "twice" ); CTLOG_INFO( "twice" );`,
+			Lines: []Line{
+				{
+					Number:       1,
+					Level:        LevelInfo,
+					FormatString: "twice",
+				},
+			},
+		},
+		{
+			Macros: nil,
+			Input: `CTLOG_VAR_INFO( "%d %d",
+                2,
+                CTLOG_TYPE_UINT( 1 ),
+                CTLOG_TYPE_UINT( 2 ) );`,
+			Lines: []Line{
+				{
+					Number:       4,
+					Start:        1,
+					Level:        LevelInfo,
+					FormatString: "%d %d",
+				},
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		x := Extractor{Macros: tc.Macros}
+		lines, err := x.FindLines(strings.NewReader(tc.Input))
+		if err != nil {
+			if !tc.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		} else {
+			if tc.ExpectErr {
+				t.Error("expected error")
+			} else if !reflect.DeepEqual(lines, tc.Lines) {
+				t.Error("data mismatch")
+				t.Error(tc.Lines)
+				t.Error(lines)
+			}
+		}
+	}
+}
+
+func TestDictionaryCollisions(t *testing.T) {
+	lines, err := FindLines(strings.NewReader(`CTLOG_INFO( "open" ); CTLOG_ERROR( "failed" );
+CTLOG_INFO( "split"
+    ); CTLOG_INFO( "end" );
+CTLOG_INFO( "first" ); CTLOG_INFO( "second"
+    );
+CTLOG_INFO( "twice" ); CTLOG_INFO( "twice" );`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lines) != 7 {
+		t.Fatalf("expected 7 lines but got %d", len(lines))
+	}
+
+	var cases = []struct {
+		LineConvention LineConvention
+		Exp            [][2]string
+	}{
+		{
+			LineConvention: LineEnd,
+			Exp:            [][2]string{{"open", "failed"}, {"split", "end"}},
+		},
+		{
+			LineConvention: LineStart,
+			Exp:            [][2]string{{"open", "failed"}, {"first", "second"}},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		dict := Dictionary{
+			LineConvention: tc.LineConvention,
+			Modules:        []Module{{Name: "main", Lines: lines}},
+		}
+		collisions := dict.Collisions()
+		if len(collisions) != len(tc.Exp) {
+			t.Fatalf("expected %d collisions but got %v", len(tc.Exp), collisions)
+		}
+		for j, c := range collisions {
+			if c.Module != "main" || c.Lines[0].FormatString != tc.Exp[j][0] || c.Lines[1].FormatString != tc.Exp[j][1] {
+				t.Errorf("unexpected collision %+v", c)
+			}
+		}
+	}
+}
+
+func TestMacroSpecUnmarshalJSON(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Spec  MacroSpec
+	}{
+		{
+			Input: `{"name": "APP_LOG", "formatArg": 1, "countArg": 2, "level": "I"}`,
+			Spec:  MacroSpec{Name: "APP_LOG", FormatArg: 1, CountArg: 2, Level: LevelInfo},
+		},
+		{
+			Input: `{"name": "RADIO_ERR", "level": "E"}`,
+			Spec:  MacroSpec{Name: "RADIO_ERR", FormatArg: 0, CountArg: -1, Level: LevelError},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		var spec MacroSpec
+		if err := json.Unmarshal([]byte(tc.Input), &spec); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if spec != tc.Spec {
+			t.Errorf("expected %+v but got %+v", tc.Spec, spec)
+		}
+	}
+}
+
+func TestParseMacroSpec(t *testing.T) {
+	var cases = []struct {
+		Input     string
+		Spec      MacroSpec
+		ExpectErr bool
+	}{
+		{
+			Input: "APP_LOG:1:2:I",
+			Spec:  MacroSpec{Name: "APP_LOG", FormatArg: 1, CountArg: 2, Level: LevelInfo},
+		},
+		{
+			Input: "RADIO_ERR:0::E",
+			Spec:  MacroSpec{Name: "RADIO_ERR", FormatArg: 0, CountArg: -1, Level: LevelError},
+		},
+		{
+			Input: "TRACE:0",
+			Spec:  MacroSpec{Name: "TRACE", FormatArg: 0, CountArg: -1},
+		},
+		{
+			Input:     "TRACE",
+			ExpectErr: true,
+		},
+		{
+			Input:     "TRACE:x:1:I",
+			ExpectErr: true,
+		},
+		{
+			Input:     "TRACE:0:1:X",
+			ExpectErr: true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		spec, err := ParseMacroSpec(tc.Input)
+		if err != nil {
+			if !tc.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		} else {
+			if tc.ExpectErr {
+				t.Error("expected error")
+			} else if spec != tc.Spec {
+				t.Errorf("expected %+v but got %+v", tc.Spec, spec)
+			}
+		}
+	}
+}
+
 func TestHasTlogLine(t *testing.T) {
 	var cases = []struct {
 		Input     string
@@ -127,9 +400,15 @@ func TestHasTlogLine(t *testing.T) {
 			ExpectErr: false,
 		},
 
+		{
+			Input:     "$TL01, ",
+			Ok:        true,
+			ExpectErr: false,
+		},
+
 		// Errors
 		{
-			Input:     "$TL01,",
+			Input:     "$TL02,",
 			Ok:        false,
 			ExpectErr: true,
 		},
@@ -176,8 +455,7 @@ func TestScanner(t *testing.T) {
 				"$TL00,11,I,1,16,1,6,^\x00Exit\n" +
 				"main$\x00,\n",
 			Lines: []string{
-				"abcdef ",
-				"$TL00,0,I,1,14,1,6,^\x00Enter main$\x00,",
+				"abcdef $TL00,0,I,1,14,1,6,^\x00Enter main$\x00,",
 				"$TL00,1,I,0,23,2,5,0,5,1,",
 				"$TL00,2,I,0,23,2,5,1,5,1,",
 				"$TL00,3,I,0,23,2,5,1,5,2,",
@@ -192,6 +470,28 @@ func TestScanner(t *testing.T) {
 			},
 			ExpectErr: false,
 		},
+		{
+			Input: "cost: $5\n" +
+				"boot: $TL00,0,I,1,14,1,3,^\x00a\r\nb$\x00, done\r\n" +
+				"$$TL00,1,I,1,16,1,3,^\x00c\nd$\x00,\n" +
+				"$TL$\n",
+			Lines: []string{
+				"cost: $5",
+				"boot: $TL00,0,I,1,14,1,3,^\x00a\r\nb$\x00, done",
+				"$$TL00,1,I,1,16,1,3,^\x00c\nd$\x00,",
+				"$TL$",
+			},
+			ExpectErr: false,
+		},
+		{
+			Input: "$TL05,0,I,1,14,0,\n" +
+				"$TL00,1,I,0,23,0,",
+			Lines: []string{
+				"$TL05,0,I,1,14,0,",
+				"$TL00,1,I,0,23,0,",
+			},
+			ExpectErr: false,
+		},
 	}
 
 	for i, tc := range cases {
@@ -289,6 +589,25 @@ func TestParseOutput(t *testing.T) {
 			},
 			ExpectErr: false,
 		},
+		{
+			Input: "$TL01,3,2,W,12,34,1,4,7,\n",
+			Ok:    true,
+			Output: &Output{
+				Version:     Version1,
+				Component:   uint32(3),
+				Sequence:    uint16(2),
+				Level:       LevelWarn,
+				ModuleIndex: uint32(12),
+				LineNumber:  uint32(34),
+				Args: []Arg{
+					{
+						Type:  TypeUint,
+						Value: uint32(7),
+					},
+				},
+			},
+			ExpectErr: false,
+		},
 	}
 
 	for i, tc := range cases {
@@ -317,6 +636,93 @@ func TestParseOutput(t *testing.T) {
 	}
 }
 
+func TestParseOutputInto(t *testing.T) {
+	var out Output
+	inputs := []string{
+		"$TL00,2,I,12,34,3,4,123,2,-1,1,74,\n",
+		"$TL01,7,3,W,1,2,1,0,1,\n",
+		"$TL00,4,E,5,6,0,\n",
+	}
+	for i, input := range inputs {
+		t.Logf("Test case %d", i)
+
+		exp, _, err := ParseOutput([]byte(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ParseOutputInto([]byte(input), &out)
+		if err != nil || !ok {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		if out.Component != exp.Component || out.Sequence != exp.Sequence || out.Level != exp.Level ||
+			out.ModuleIndex != exp.ModuleIndex || out.LineNumber != exp.LineNumber ||
+			len(out.Args) != len(exp.Args) {
+			t.Errorf("expected %+v but got %+v", exp, out)
+			continue
+		}
+		for j := range out.Args {
+			if out.Args[j] != exp.Args[j] {
+				t.Errorf("argument %d: expected %+v but got %+v", j, exp.Args[j], out.Args[j])
+			}
+		}
+	}
+
+	// Lines without string arguments or large values shouldn't allocate once
+	// the Args capacity has grown
+	data := []byte("$TL00,2,I,12,34,2,0,1,1,74,\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := ParseOutputInto(data, &out); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations but got %v", allocs)
+	}
+
+	for i, input := range []string{
+		"$TL00,2,I,12,34,1,4,4294967296,\n",
+		"$TL00,2,I,12,34,1,2,-2147483649,\n",
+		"$TL00,2,I,12,34,1,2,2147483648,\n",
+		"$TL00,2,I,12,34,1,0,2,\n",
+		"$TL00,2,I,12,x,0,\n",
+		"$TL00,2,I,12,34,1,3,^\x00missing end,\n",
+		"$TL00,2,",
+	} {
+		t.Logf("Error case %d", i)
+
+		if _, err := ParseOutputInto([]byte(input), &out); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func BenchmarkParseOutputInto(b *testing.B) {
+	data := []byte("$TL00,2,I,12,34,4,4,123,2,-1,1,74,3,^\x00Exit fibonacci_log$\x00,\n")
+
+	var out Output
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseOutputInto(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseOutput(b *testing.B) {
+	data := []byte("$TL00,2,I,12,34,4,4,123,2,-1,1,74,3,^\x00Exit fibonacci_log$\x00,\n")
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseOutput(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestTranslator(t *testing.T) {
 	var cases = []struct {
 		Module  Module
@@ -373,6 +779,32 @@ func TestTranslator(t *testing.T) {
 			},
 			ExpectErr: false,
 		},
+		{
+			Module: Module{
+				Index: 0,
+				Name:  "module_0",
+				Path:  "/path/to/module_0.c",
+				Lines: []Line{
+					{
+						Number:       123,
+						FormatString: "first",
+					},
+					{
+						Number:       123,
+						FormatString: "second",
+					},
+				},
+			},
+			Outputs: []Output{
+				{
+					Sequence:    0,
+					Level:       LevelInfo,
+					ModuleIndex: 0,
+					LineNumber:  123,
+				},
+			},
+			ExpectErr: true,
+		},
 	}
 
 	for i, tc := range cases {
@@ -401,6 +833,53 @@ func TestTranslator(t *testing.T) {
 	}
 }
 
+func TestTranslatorLineConvention(t *testing.T) {
+	dict := Dictionary{
+		Modules: []Module{
+			{
+				Index: 0,
+				Name:  "module_0",
+				Lines: []Line{
+					{Number: 12, Start: 10, FormatString: "multi"},
+					{Number: 10, Start: 8, FormatString: "other"},
+					{Number: 20, FormatString: "single"},
+				},
+			},
+		},
+	}
+
+	var cases = []struct {
+		LineConvention LineConvention
+		Line           uint32
+		Exp            string
+	}{
+		{LineConvention: "", Line: 12, Exp: "multi"},
+		{LineConvention: "", Line: 10, Exp: "other"},
+		{LineConvention: LineEnd, Line: 20, Exp: "single"},
+		{LineConvention: LineStart, Line: 10, Exp: "multi"},
+		{LineConvention: LineStart, Line: 12, Exp: "multi"},
+		{LineConvention: LineStart, Line: 20, Exp: "single"},
+		{LineConvention: LineStart, Line: 8, Exp: "other"},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		dict.LineConvention = tc.LineConvention
+		s, err := NewDictionaryTranslator(&dict).Translate(&Output{LineNumber: tc.Line})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if s != tc.Exp {
+			t.Errorf("expected %q but got %q", tc.Exp, s)
+		}
+	}
+
+	var lc LineConvention
+	if err := json.Unmarshal([]byte(`"middle"`), &lc); err == nil {
+		t.Error("expected error for unsupported line convention")
+	}
+}
+
 func TestUnmarshalOutput(t *testing.T) {
 	var out Output
 	if err := json.Unmarshal([]byte(`{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":3,"v":"Hello \\ \" \u0001 World"}]}`), &out); err != nil {
@@ -408,3 +887,117 @@ func TestUnmarshalOutput(t *testing.T) {
 	}
 	t.Logf("%+v", out)
 }
+
+func TestMarshalOutput(t *testing.T) {
+	var args []Arg
+	for c := 0; c < 256; c++ {
+		args = append(args, Arg{Type: TypeChar, Value: byte(c)})
+	}
+	args = append(args,
+		Arg{Type: TypeBool, Value: true},
+		Arg{Type: TypeInt, Value: int32(-7)},
+		Arg{Type: TypeString, Value: "<tag> & \"quotes\"\n"},
+		Arg{Type: TypeUint, Value: uint32(4294967295)},
+		Arg{Type: TypeString, Value: "\xff valid é \U0001F600 \xe2\x82 \xc3"},
+		Arg{Type: TypeString, Value: "\u00e9\xe9"},
+	)
+
+	var cases = []Output{
+		{Version: Version0, Sequence: 1, Level: LevelInfo, ModuleIndex: 2, LineNumber: 3, Args: []Arg{}},
+		{Version: Version1, Component: 4, Sequence: 5, Level: LevelError, ModuleIndex: 6, LineNumber: 7, Args: args},
+		{Args: []Arg{}},
+	}
+
+	for i, exp := range cases {
+		t.Logf("Test case %d", i)
+
+		data, err := json.Marshal(exp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var out Output
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(out, exp) {
+			t.Errorf("round trip mismatch:\n%+v\n%+v", exp, out)
+		}
+	}
+
+	// Without characters that need escaping the output matches the C code
+	data, err := json.Marshal(&Output{Sequence: 7, Level: LevelInfo, ModuleIndex: 0, LineNumber: 20, Args: []Arg{{Type: TypeChar, Value: byte('J')}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":1,"v":"J"}]}`; string(data) != exp {
+		t.Errorf("expected %s but got %s", exp, data)
+	}
+
+	for i, input := range []string{
+		`{"ctlog":5,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[]}`,
+		`{"ctlog":0,"seq":7,"lvl":"X","mi":0,"ml":20,"args":[]}`,
+		`{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":2,"v":4294967295}]}`,
+		`{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":4,"v":"5"}]}`,
+		`{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":1,"v":""}]}`,
+		`{"ctlog":0,"seq":7,"lvl":"I","mi":0,"ml":20,"args":[{"t":9,"v":1}]}`,
+	} {
+		t.Logf("Error case %d", i)
+
+		var out Output
+		if err := json.Unmarshal([]byte(input), &out); err == nil {
+			t.Errorf("expected error for %s", input)
+		}
+	}
+
+	if _, err := json.Marshal(Output{Component: 1, Level: LevelInfo}); err == nil {
+		t.Error("expected error marshalling a component ID with version 0")
+	}
+}
+
+func TestUnmarshalOutputRaw(t *testing.T) {
+	// The C code writes bytes that aren't ASCII as is, even if they aren't
+	// valid UTF-8
+	input := "{\"ctlog\":0,\"seq\":7,\"lvl\":\"I\",\"mi\":0,\"ml\":20,\"args\":[" +
+		"{\"t\":1,\"v\":\"\xe9\"},{\"t\":3,\"v\":\"\xff \\ud83d\\ude00 \\ud83d \\u00e9\"}]}"
+	exp := []Arg{
+		{Type: TypeChar, Value: byte(0xE9)},
+		{Type: TypeString, Value: "\xff \U0001F600 \uFFFD \xe9"},
+	}
+
+	var out Output
+	if err := json.Unmarshal([]byte(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Args, exp) {
+		t.Errorf("expected %+v but got %+v", exp, out.Args)
+	}
+}
+
+func TestMarshalTextRecord(t *testing.T) {
+	rec := Record{
+		Encoding: EncodingText,
+		Data:     []byte("text"),
+		Line:     1,
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(data), `"lvl":""`) {
+		t.Errorf("expected an empty level in %s", data)
+	}
+
+	var out Record
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec.Output.Args = []Arg{}
+	if !reflect.DeepEqual(out, rec) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", rec, out)
+	}
+
+	// The decoder still requires a level
+	if _, err := NewDecoder(strings.NewReader(`{"ctlog":0,"seq":7,"lvl":"","mi":0,"ml":20,"args":[]}` + "\n")).Next(); err == nil {
+		t.Error("expected error decoding a JSON record without a level")
+	}
+}
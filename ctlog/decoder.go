@@ -0,0 +1,423 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"unicode/utf8"
+)
+
+// DefaultMaxLineSize is the default maximum size of a line read by a Decoder.
+const DefaultMaxLineSize = 1 << 20
+
+// An Encoding is the encoding of a line of output.
+type Encoding int
+
+const (
+	// EncodingText is a line that isn't tokenized, e.g. output from printf.
+	EncodingText Encoding = iota
+
+	// EncodingTL is the '$TL' format output by ctlog_fprintf.
+	EncodingTL
+
+	// EncodingJSON is the JSON format output by ctlog_json_fprintf.
+	EncodingJSON
+
+	// EncodingBase64 is the base64 encoded binary format output by
+	// ctlog_base64_fprintf, see Base64Prefix.
+	EncodingBase64
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingText:
+		return "text"
+	case EncodingTL:
+		return "$TL"
+	case EncodingJSON:
+		return "JSON"
+	case EncodingBase64:
+		return "base64"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+var jsonPrefix = []byte(`{"ctlog":`)
+
+// DetectEncoding returns the encoding of a line of output that starts with
+// a tokenized logging record, see FindRecord for records following other
+// text.
+func DetectEncoding(line []byte) Encoding {
+	switch {
+	case len(line) >= 6 && string(line[0:3]) == MagicString && line[5] == ',':
+		return EncodingTL
+	case bytes.HasPrefix(line, jsonPrefix):
+		return EncodingJSON
+	case isBase64Record(line):
+		return EncodingBase64
+	default:
+		return EncodingText
+	}
+}
+
+// FindRecord returns the start and encoding of the first tokenized logging
+// record in a line of output, which may be preceded by other text, e.g. from
+// printf. start is -1 if there isn't one.
+func FindRecord(line []byte) (start int, enc Encoding) {
+	for start = 0; start < len(line); start++ {
+		i := bytes.IndexAny(line[start:], "${~")
+		if i < 0 {
+			break
+		}
+		start += i
+		if enc = DetectEncoding(line[start:]); enc != EncodingText {
+			return
+		}
+	}
+	return -1, EncodingText
+}
+
+// decodeLine finds the tokenized logging record in a line and decodes it into
+// output, returning where the record starts and ends in the line.
+func decodeLine(line []byte, output *Output) (enc Encoding, start, end int, err error) {
+	start, enc = FindRecord(line)
+	switch enc {
+	case EncodingTL:
+		var n int
+		n, _, err = parseOutput(line[start:], output)
+		end = start + n
+	case EncodingJSON:
+		end = start + jsonEnd(line[start:])
+		err = json.Unmarshal(line[start:end], output)
+		if err == nil {
+			err = output.Level.check()
+		}
+	case EncodingBase64:
+		var n int
+		n, err = decodeBase64(line[start:], output)
+		end = start + n
+	}
+	return
+}
+
+// jsonEnd returns the length of the JSON object at the start of data, or
+// len(data) if it isn't terminated.
+func jsonEnd(data []byte) int {
+	var (
+		depth int
+		inStr bool
+	)
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inStr && c == '\\':
+			i++
+		case c == '"':
+			inStr = !inStr
+		case inStr:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(data)
+}
+
+// A Record is a line of output read by a Decoder.
+type Record struct {
+	// Encoding is the encoding of the line, Output is only valid if it isn't
+	// EncodingText.
+	Encoding Encoding
+
+	// Output is the decoded tokenized logging output.
+	Output Output
+
+	// Data is the line without its line ending. Tokenized lines may contain
+	// newlines within string arguments.
+	Data []byte
+
+	// Leading and Trailing are the text before and after the tokenized
+	// record in Data, e.g. from a printf that doesn't end with a newline.
+	Leading  []byte
+	Trailing []byte
+
+	// Offset is the byte offset of the start of the line in the input.
+	Offset int64
+
+	// Line is the line number of the start of the line in the input, starting
+	// at 1.
+	Line int
+
+	// Truncated is true if the line was longer than the decoder's maximum
+	// line size and the rest of it was discarded.
+	Truncated bool
+
+	// Device is the ID of the device that output the line if the decoder
+	// has a device prefix and the line had one.
+	Device string
+}
+
+// IsToken returns true if the record is tokenized logging output.
+func (r *Record) IsToken() bool {
+	return r.Encoding != EncodingText
+}
+
+// A SyntaxError is returned for a line that looks like tokenized logging
+// output but can't be decoded.
+type SyntaxError struct {
+	Encoding Encoding
+	Offset   int64
+	Line     int
+	Err      error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d (offset %d): invalid %s record: %v", e.Line, e.Offset, e.Encoding, e.Err)
+}
+
+// A Decoder reads lines of output, which may be plain text interleaved with
+// tokenized logging output in any encoding, and decodes them into
+// records.
+//
+// Lines longer than MaxLineSize are truncated, and invalid UTF-8 and NUL
+// bytes in lines that aren't tokenized are removed since they're usually
+// noise, e.g. from a baud rate mismatch. Lines that are only noise are
+// skipped entirely. The number of bytes removed is returned by Discarded.
+type Decoder struct {
+	// MaxLineSize is the maximum size of a line in bytes, the rest of a
+	// longer line is discarded. If zero DefaultMaxLineSize is used.
+	MaxLineSize int
+
+	// DevicePrefix, if set, matches a prefix added to the start of each line
+	// by something combining the output of several devices, e.g. a hub that
+	// adds "[dev3] ". The prefix is removed before the line is decoded and
+	// the device ID in it is set in the record. The device ID is the group
+	// named "device", else the first group, else the whole prefix.
+	DevicePrefix *regexp.Regexp
+
+	s *bufio.Scanner
+
+	offset    int64 // offset of the next line
+	line      int   // line number of the next line
+	recOffset int64
+	recLine   int
+	recDevice string
+
+	data      []byte // current line with any noise removed
+	buf       []byte
+	truncated bool  // current line was truncated
+	skipping  bool  // discarding the rest of a truncated line
+	discarded int64 // bytes discarded
+
+	output Output
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{
+		line: 1,
+	}
+	d.s = bufio.NewScanner(r)
+	d.s.Split(d.split)
+	// Lines are limited by split instead so they can be truncated rather
+	// than stopping the scanner
+	d.s.Buffer(nil, math.MaxInt32)
+	return d
+}
+
+// Discarded returns the number of bytes of noise and truncated lines that
+// have been discarded.
+func (d *Decoder) Discarded() int64 {
+	return d.discarded
+}
+
+// split wraps ScanLines to keep track of where each line starts and to
+// truncate long lines.
+func (d *Decoder) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if d.skipping {
+		// Discard the rest of the truncated line
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			advance = len(data)
+		} else {
+			advance = i + 1
+			d.skipping = false
+			d.discarded += int64(i)
+			d.offset += int64(advance)
+			d.line++
+			return
+		}
+		d.discarded += int64(advance)
+		d.offset += int64(advance)
+		return
+	}
+
+	maxSize := d.MaxLineSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxLineSize
+	}
+
+	var (
+		prefix int
+		device string
+	)
+	if d.DevicePrefix != nil {
+		// Only the first line of a record is matched so wait until it's
+		// been read
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i]
+		} else if !atEOF && len(data) < maxSize {
+			return
+		}
+		if prefix, device = matchDevicePrefix(d.DevicePrefix, line); prefix >= maxSize {
+			prefix, device = 0, ""
+		}
+	}
+
+	advance, token, err = ScanLines(data[prefix:], atEOF)
+	if token == nil && atEOF && prefix > 0 && prefix == len(data) {
+		// Only a prefix at the end of the input
+		token = data[prefix:]
+	}
+	d.truncated = false
+	if token != nil && len(token) > maxSize {
+		// The whole line was buffered but it's still too long
+		d.discarded += int64(len(token) - maxSize)
+		token = token[:maxSize]
+		d.truncated = true
+	} else if token == nil && len(data) >= maxSize {
+		// Return the start of the line and discard the rest as it's read
+		advance = maxSize - prefix
+		token = data[prefix:maxSize]
+		d.truncated = true
+		d.skipping = true
+	}
+	if token != nil {
+		advance += prefix
+		d.recOffset = d.offset
+		d.recLine = d.line
+		d.recDevice = device
+		d.offset += int64(advance)
+		d.line += bytes.Count(data[:advance], []byte{'\n'})
+	}
+	return
+}
+
+// matchDevicePrefix returns the length of the device prefix at the start of
+// line and the device ID in it, or zero if there isn't one.
+func matchDevicePrefix(re *regexp.Regexp, line []byte) (n int, device string) {
+	loc := re.FindSubmatchIndex(line)
+	if loc == nil || loc[0] != 0 {
+		return
+	}
+	n = loc[1]
+
+	group := 0
+	if i := re.SubexpIndex("device"); i > 0 {
+		group = i
+	} else if re.NumSubexp() > 0 {
+		group = 1
+	}
+	if start, end := loc[2*group], loc[2*group+1]; start >= 0 {
+		device = string(line[start:end])
+	}
+	return
+}
+
+// scan reads the next line into d.data, removing any noise from the text
+// before a tokenized record, or from the whole line if there isn't one.
+func (d *Decoder) scan() bool {
+	for d.s.Scan() {
+		d.data = d.s.Bytes()
+
+		text := d.data
+		if start, _ := FindRecord(d.data); start >= 0 {
+			text = d.data[:start]
+		}
+		if clean, n := cleanText(d.buf, text); n > 0 {
+			d.discarded += int64(n)
+			d.buf = append(clean, d.data[len(text):]...)
+			d.data = d.buf
+			if len(d.data) == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// cleanText removes invalid UTF-8 and NUL bytes from line and returns the
+// result and the number of bytes removed. buf is used to hold the result if
+// anything is removed, otherwise line is returned.
+func cleanText(buf, line []byte) (clean []byte, n int) {
+	if utf8.Valid(line) && bytes.IndexByte(line, 0) < 0 {
+		return line, 0
+	}
+	clean = buf[:0]
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRune(line[i:])
+		if (r == utf8.RuneError && size == 1) || r == 0 {
+			n += size
+		} else {
+			clean = append(clean, line[i:i+size]...)
+		}
+		i += size
+	}
+	return
+}
+
+// Next returns the next record. At the end of the input it returns io.EOF.
+// If a line can't be decoded a *SyntaxError is returned along with the
+// record, and decoding can continue by calling Next again. Any other error
+// is returned by every following call.
+//
+// The record's Data and Output.Args are only valid until the next call to
+// Next.
+func (d *Decoder) Next() (rec Record, err error) {
+	if !d.scan() {
+		err = d.s.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+
+	rec.Data = d.data
+	rec.Offset = d.recOffset
+	rec.Line = d.recLine
+	rec.Truncated = d.truncated
+	rec.Device = d.recDevice
+
+	var start, end int
+	rec.Encoding, start, end, err = decodeLine(rec.Data, &d.output)
+	if err != nil {
+		err = &SyntaxError{
+			Encoding: rec.Encoding,
+			Offset:   rec.Offset,
+			Line:     rec.Line,
+			Err:      err,
+		}
+		return
+	}
+	if rec.IsToken() {
+		rec.Output = d.output
+		rec.Leading = rec.Data[:start]
+		rec.Trailing = rec.Data[end:]
+	}
+	return
+}
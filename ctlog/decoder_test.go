@@ -0,0 +1,321 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	input := "booting\n" +
+		"$TL00,0,I,1,14,1,3,^\x00Enter\nmain$\x00,\n" +
+		`{"ctlog":0,"seq":1,"lvl":"W","mi":0,"ml":23,"args":[{"t":4,"v":5}]}` + "\r\n" +
+		"$TL05,2,I,0,23,0,\n" +
+		`{"ctlog":0,"seq":"x"}` + "\n" +
+		`{"not":"ctlog"}` + "\n" +
+		"$TL00,3,E,0,30,0,"
+
+	var cases = []struct {
+		Encoding    Encoding
+		Data        string
+		Offset      int64
+		Line        int
+		Sequence    uint16
+		SyntaxError bool
+	}{
+		{Encoding: EncodingText, Data: "booting", Offset: 0, Line: 1},
+		{Encoding: EncodingTL, Data: "$TL00,0,I,1,14,1,3,^\x00Enter\nmain$\x00,", Offset: 8, Line: 2, Sequence: 0},
+		{Encoding: EncodingJSON, Data: `{"ctlog":0,"seq":1,"lvl":"W","mi":0,"ml":23,"args":[{"t":4,"v":5}]}`, Offset: 43, Line: 4, Sequence: 1},
+		{Encoding: EncodingTL, Data: "$TL05,2,I,0,23,0,", Offset: 112, Line: 5, SyntaxError: true},
+		{Encoding: EncodingJSON, Data: `{"ctlog":0,"seq":"x"}`, Offset: 130, Line: 6, SyntaxError: true},
+		{Encoding: EncodingText, Data: `{"not":"ctlog"}`, Offset: 152, Line: 7},
+		{Encoding: EncodingTL, Data: "$TL00,3,E,0,30,0,", Offset: 168, Line: 8, Sequence: 3},
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		rec, err := d.Next()
+		if err != nil {
+			if serr, ok := err.(*SyntaxError); !ok || !tc.SyntaxError {
+				t.Fatalf("unexpected error: %v", err)
+			} else if serr.Line != tc.Line || serr.Offset != tc.Offset || serr.Encoding != tc.Encoding {
+				t.Errorf("unexpected syntax error %+v", serr)
+			}
+		} else if tc.SyntaxError {
+			t.Error("expected syntax error")
+		}
+
+		if rec.Encoding != tc.Encoding {
+			t.Errorf("expected %s encoding but got %s", tc.Encoding, rec.Encoding)
+		}
+		if string(rec.Data) != tc.Data {
+			t.Errorf("expected data %q but got %q", tc.Data, rec.Data)
+		}
+		if rec.Offset != tc.Offset || rec.Line != tc.Line {
+			t.Errorf("expected offset %d line %d but got offset %d line %d", tc.Offset, tc.Line, rec.Offset, rec.Line)
+		}
+		if rec.IsToken() && err == nil && rec.Output.Sequence != tc.Sequence {
+			t.Errorf("expected sequence %d but got %d", tc.Sequence, rec.Output.Sequence)
+		}
+	}
+
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+}
+
+func TestDecoderLongLines(t *testing.T) {
+	input := "short\n" +
+		strings.Repeat("a", 20) + "\n" +
+		strings.Repeat("b", 100000) + "\r\n" +
+		"$TL00,0,I,0,1,0,\n" +
+		strings.Repeat("c", 100000)
+
+	var cases = []struct {
+		Data      string
+		Offset    int64
+		Line      int
+		Truncated bool
+	}{
+		{Data: "short", Offset: 0, Line: 1},
+		{Data: strings.Repeat("a", 16), Offset: 6, Line: 2, Truncated: true},
+		{Data: strings.Repeat("b", 16), Offset: 27, Line: 3, Truncated: true},
+		{Data: "$TL00,0,I,0,1,0,", Offset: 100029, Line: 4},
+		{Data: strings.Repeat("c", 16), Offset: 100046, Line: 5, Truncated: true},
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	d.MaxLineSize = 16
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		rec, err := d.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(rec.Data) != tc.Data {
+			t.Errorf("expected data %q but got %q", tc.Data, rec.Data)
+		}
+		if rec.Offset != tc.Offset || rec.Line != tc.Line {
+			t.Errorf("expected offset %d line %d but got offset %d line %d", tc.Offset, tc.Line, rec.Offset, rec.Line)
+		}
+		if rec.Truncated != tc.Truncated {
+			t.Errorf("expected truncated %t but got %t", tc.Truncated, rec.Truncated)
+		}
+	}
+
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if exp := int64(4 + 100000 - 16 + 1 + 100000 - 16); d.Discarded() != exp {
+		t.Errorf("expected %d bytes discarded but got %d", exp, d.Discarded())
+	}
+}
+
+func TestDecoderNoise(t *testing.T) {
+	input := "\xff\xfe\x00ok \xc3\xa9\n" +
+		"\x80\x81\x00\n" +
+		"$TL00,0,I,0,1,1,3,^\x00\xff$\x00,\n" +
+		"done\n"
+
+	var cases = []struct {
+		Data string
+		Line int
+	}{
+		{Data: "ok \xc3\xa9", Line: 1},
+		{Data: "$TL00,0,I,0,1,1,3,^\x00\xff$\x00,", Line: 3},
+		{Data: "done", Line: 4},
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		rec, err := d.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(rec.Data) != tc.Data {
+			t.Errorf("expected data %q but got %q", tc.Data, rec.Data)
+		}
+		if rec.Line != tc.Line {
+			t.Errorf("expected line %d but got %d", tc.Line, rec.Line)
+		}
+	}
+
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if d.Discarded() != 6 {
+		t.Errorf("expected 6 bytes discarded but got %d", d.Discarded())
+	}
+}
+
+func TestDecoderDevicePrefix(t *testing.T) {
+	input := "[dev3] $TL00,4,I,0,10,1,4,1,\n" +
+		"[dev1] booting\n" +
+		"no prefix\n" +
+		`[dev3] {"ctlog":0,"seq":5,"lvl":"I","mi":0,"ml":10,"args":[]}` + "\n" +
+		"[dev12] $TL00,0,I,1,14,1,3,^\x00Enter\nmain$\x00,\n" +
+		"[dev1] "
+
+	var cases = []struct {
+		Encoding Encoding
+		Data     string
+		Device   string
+		Line     int
+		Offset   int64
+	}{
+		{Encoding: EncodingTL, Data: "$TL00,4,I,0,10,1,4,1,", Device: "dev3", Line: 1, Offset: 0},
+		{Encoding: EncodingText, Data: "booting", Device: "dev1", Line: 2, Offset: 29},
+		{Encoding: EncodingText, Data: "no prefix", Device: "", Line: 3, Offset: 44},
+		{Encoding: EncodingJSON, Data: `{"ctlog":0,"seq":5,"lvl":"I","mi":0,"ml":10,"args":[]}`, Device: "dev3", Line: 4, Offset: 54},
+		{Encoding: EncodingTL, Data: "$TL00,0,I,1,14,1,3,^\x00Enter\nmain$\x00,", Device: "dev12", Line: 5, Offset: 116},
+		{Encoding: EncodingText, Data: "", Device: "dev1", Line: 7, Offset: 159},
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	d.DevicePrefix = regexp.MustCompile(`^\[(\w+)\] `)
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		rec, err := d.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Encoding != tc.Encoding {
+			t.Errorf("expected %s encoding but got %s", tc.Encoding, rec.Encoding)
+		}
+		if string(rec.Data) != tc.Data {
+			t.Errorf("expected data %q but got %q", tc.Data, rec.Data)
+		}
+		if rec.Device != tc.Device {
+			t.Errorf("expected device %q but got %q", tc.Device, rec.Device)
+		}
+		if rec.Offset != tc.Offset || rec.Line != tc.Line {
+			t.Errorf("expected offset %d line %d but got offset %d line %d", tc.Offset, tc.Line, rec.Offset, rec.Line)
+		}
+	}
+
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+}
+
+func TestMatchDevicePrefix(t *testing.T) {
+	var cases = []struct {
+		Expr   string
+		Line   string
+		N      int
+		Device string
+	}{
+		{Expr: `^\[(\w+)\] `, Line: "[dev3] hello", N: 7, Device: "dev3"},
+		{Expr: `^\[(\w+)\] `, Line: "hello [dev3] ", N: 0, Device: ""},
+		{Expr: `\[(\w+)\] `, Line: "hello [dev3] ", N: 0, Device: ""},
+		{Expr: `^(\d+):(?P<device>\w+)> `, Line: "12:uart2> hello", N: 10, Device: "uart2"},
+		{Expr: `^dev\d+: `, Line: "dev7: hello", N: 6, Device: "dev7: "},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		n, device := matchDevicePrefix(regexp.MustCompile(tc.Expr), []byte(tc.Line))
+		if n != tc.N || device != tc.Device {
+			t.Errorf("expected %d %q but got %d %q", tc.N, tc.Device, n, device)
+		}
+	}
+}
+
+func TestFindRecord(t *testing.T) {
+	var cases = []struct {
+		Line     string
+		Start    int
+		Encoding Encoding
+	}{
+		{Line: "$TL00,0,I,0,10,0,", Start: 0, Encoding: EncodingTL},
+		{Line: "boot: $TL00,0,I,0,10,0,", Start: 6, Encoding: EncodingTL},
+		{Line: "cost: $5 $TL01,", Start: 9, Encoding: EncodingTL},
+		{Line: `{"a":1} {"ctlog":0}`, Start: 8, Encoding: EncodingJSON},
+		{Line: "boot: ~AABJAyoA", Start: 6, Encoding: EncodingBase64},
+		{Line: "cost: $5", Start: -1, Encoding: EncodingText},
+		{Line: "cd ~/src/ctlog", Start: -1, Encoding: EncodingText},
+		{Line: "~AABJ", Start: -1, Encoding: EncodingText},
+		{Line: "$TL", Start: -1, Encoding: EncodingText},
+		{Line: "", Start: -1, Encoding: EncodingText},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		start, enc := FindRecord([]byte(tc.Line))
+		if start != tc.Start || enc != tc.Encoding {
+			t.Errorf("expected %d %s but got %d %s", tc.Start, tc.Encoding, start, enc)
+		}
+	}
+}
+
+func TestDecoderEmbedded(t *testing.T) {
+	input := "boot: $TL00,0,I,0,10,1,4,7, ok\n" +
+		`vendor {"ctlog":0,"seq":1,"lvl":"I","mi":0,"ml":20,"args":[{"t":3,"v":"a}\"b"}]} tail` + "\n" +
+		"cost: $5\n" +
+		"\xff\xfe$TL00,2,I,0,10,0,\n" +
+		"x $TL00,3,I,0,10,1,4,\n" +
+		"boot: ~AABJAyoA ok\n" +
+		"cd ~/src/ctlog\n" +
+		"~AABJAyoAAA\n"
+
+	var cases = []struct {
+		Encoding    Encoding
+		Leading     string
+		Trailing    string
+		LineNumber  uint32
+		SyntaxError bool
+	}{
+		{Encoding: EncodingTL, Leading: "boot: ", Trailing: " ok", LineNumber: 10},
+		{Encoding: EncodingJSON, Leading: "vendor ", Trailing: " tail", LineNumber: 20},
+		{Encoding: EncodingText},
+		{Encoding: EncodingTL, Leading: "", Trailing: "", LineNumber: 10},
+		{Encoding: EncodingTL, SyntaxError: true},
+		{Encoding: EncodingBase64, Leading: "boot: ", Trailing: " ok", LineNumber: 42},
+		{Encoding: EncodingText},
+		{Encoding: EncodingBase64, SyntaxError: true},
+	}
+
+	d := NewDecoder(strings.NewReader(input))
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		rec, err := d.Next()
+		if _, ok := err.(*SyntaxError); ok && tc.SyntaxError {
+			continue
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if tc.SyntaxError {
+			t.Fatal("expected syntax error")
+		}
+
+		if rec.Encoding != tc.Encoding {
+			t.Errorf("expected %s encoding but got %s", tc.Encoding, rec.Encoding)
+		}
+		if string(rec.Leading) != tc.Leading || string(rec.Trailing) != tc.Trailing {
+			t.Errorf("expected text %q and %q but got %q and %q", tc.Leading, tc.Trailing, rec.Leading, rec.Trailing)
+		}
+		if rec.IsToken() && rec.Output.LineNumber != tc.LineNumber {
+			t.Errorf("expected line number %d but got %d", tc.LineNumber, rec.Output.LineNumber)
+		}
+	}
+
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if d.Discarded() != 2 {
+		t.Errorf("expected 2 bytes discarded but got %d", d.Discarded())
+	}
+}
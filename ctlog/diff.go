@@ -0,0 +1,379 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"encoding"
+	"fmt"
+	"sort"
+)
+
+type DiffKind int
+
+const (
+	// ModuleAdded is a module that only exists in the new dictionary.
+	ModuleAdded DiffKind = iota
+
+	// ModuleRemoved is a module that only exists in the old dictionary.
+	ModuleRemoved
+
+	// ModuleIndexChanged is a module whose index changed.
+	ModuleIndexChanged
+
+	// LineAdded is a line that only exists in the new dictionary.
+	LineAdded
+
+	// LineRemoved is a line that only exists in the old dictionary.
+	LineRemoved
+
+	// LineMoved is a line whose format string is unchanged but whose output
+	// line number changed.
+	LineMoved
+
+	// LineReworded is a line whose output line number is unchanged but whose
+	// format string or level changed.
+	LineReworded
+
+	// ModulePathChanged is a module whose source file moved.
+	ModulePathChanged
+
+	// ComponentAdded is a component that only exists in the new merged
+	// dictionary.
+	ComponentAdded
+
+	// ComponentRemoved is a component that only exists in the old merged
+	// dictionary.
+	ComponentRemoved
+
+	// LineConventionChanged is a change to the dictionary's line convention.
+	LineConventionChanged
+)
+
+var diffKindNames = []string{
+	ModuleAdded:        "module-added",
+	ModuleRemoved:      "module-removed",
+	ModuleIndexChanged: "module-index-changed",
+	LineAdded:          "line-added",
+	LineRemoved:        "line-removed",
+	LineMoved:          "line-moved",
+	LineReworded:       "line-reworded",
+	ModulePathChanged:  "module-path-changed",
+	ComponentAdded:     "component-added",
+	ComponentRemoved:   "component-removed",
+
+	LineConventionChanged: "line-convention-changed",
+}
+
+var (
+	_ encoding.TextMarshaler   = DiffKind(0)
+	_ encoding.TextUnmarshaler = (*DiffKind)(nil)
+)
+
+func (k DiffKind) String() string {
+	if k < 0 || int(k) >= len(diffKindNames) {
+		return fmt.Sprintf("DiffKind(%d)", int(k))
+	}
+	return diffKindNames[k]
+}
+
+func (k DiffKind) MarshalText() (data []byte, err error) {
+	if k < 0 || int(k) >= len(diffKindNames) {
+		err = fmt.Errorf("unsupported diff kind %d", int(k))
+		return
+	}
+	data = []byte(diffKindNames[k])
+	return
+}
+
+func (k *DiffKind) UnmarshalText(data []byte) (err error) {
+	for i, name := range diffKindNames {
+		if name == string(data) {
+			*k = DiffKind(i)
+			return
+		}
+	}
+	err = fmt.Errorf("unsupported diff kind '%s'", string(data))
+	return
+}
+
+// A Diff is a single difference between two dictionaries.
+type Diff struct {
+	Kind DiffKind `json:"kind"`
+
+	// Component is the ID of the component the difference is in, or nil if
+	// the dictionaries aren't merged.
+	Component *uint32 `json:"component,omitempty"`
+
+	// Module is the name of the module the difference is in.
+	Module string `json:"module"`
+
+	// OldIndex and NewIndex are the index of the module in the old and new
+	// dictionaries, or -1 if it doesn't exist in one of them.
+	OldIndex int `json:"oldIndex"`
+	NewIndex int `json:"newIndex"`
+
+	// OldPath and NewPath are the old and new paths of a module whose path
+	// changed.
+	OldPath string `json:"oldPath,omitempty"`
+	NewPath string `json:"newPath,omitempty"`
+
+	// OldLineConvention and NewLineConvention are the old and new line
+	// conventions of a line convention change.
+	OldLineConvention LineConvention `json:"oldLineConvention,omitempty"`
+	NewLineConvention LineConvention `json:"newLineConvention,omitempty"`
+
+	// Old and New are the old and new lines of a line difference. Old is nil
+	// for added lines and New is nil for removed lines.
+	Old *Line `json:"old,omitempty"`
+	New *Line `json:"new,omitempty"`
+
+	// OldNumber and NewNumber are the line numbers output by the old and new
+	// lines using their dictionary's line convention.
+	OldNumber int `json:"oldNumber,omitempty"`
+	NewNumber int `json:"newNumber,omitempty"`
+}
+
+func (d Diff) String() string {
+	if d.Component != nil {
+		switch d.Kind {
+		case ComponentAdded:
+			return fmt.Sprintf("component %d: added", *d.Component)
+		case ComponentRemoved:
+			return fmt.Sprintf("component %d: removed", *d.Component)
+		}
+		c := d
+		c.Component = nil
+		return fmt.Sprintf("component %d: %s", *d.Component, c)
+	}
+
+	switch d.Kind {
+	case LineConventionChanged:
+		return fmt.Sprintf("line convention changed from %s to %s", d.OldLineConvention, d.NewLineConvention)
+	case ModuleAdded:
+		return fmt.Sprintf("%s: module added with index %d", d.Module, d.NewIndex)
+	case ModuleRemoved:
+		return fmt.Sprintf("%s: module removed, was index %d", d.Module, d.OldIndex)
+	case ModuleIndexChanged:
+		return fmt.Sprintf("%s: module index changed from %d to %d", d.Module, d.OldIndex, d.NewIndex)
+	case ModulePathChanged:
+		return fmt.Sprintf("%s: module moved from %s to %s", d.Module, d.OldPath, d.NewPath)
+	case LineAdded:
+		return fmt.Sprintf("%s: line %d added %q", d.Module, d.NewNumber, d.New.FormatString)
+	case LineRemoved:
+		return fmt.Sprintf("%s: line %d removed %q", d.Module, d.OldNumber, d.Old.FormatString)
+	case LineMoved:
+		return fmt.Sprintf("%s: line %d moved to line %d %q", d.Module, d.OldNumber, d.NewNumber, d.New.FormatString)
+	case LineReworded:
+		if d.Old.FormatString == d.New.FormatString {
+			return fmt.Sprintf("%s: line %d level changed from %s to %s %q", d.Module, d.NewNumber, levelString(d.Old.Level), levelString(d.New.Level), d.New.FormatString)
+		}
+		return fmt.Sprintf("%s: line %d reworded from %q to %q", d.Module, d.NewNumber, d.Old.FormatString, d.New.FormatString)
+	}
+	return d.Kind.String()
+}
+
+func levelString(lvl Level) string {
+	if lvl == 0 {
+		return "unknown"
+	}
+	return string(lvl)
+}
+
+// Diff returns the differences between d and a newer dictionary, including a
+// change to the line convention. The modules of merged dictionaries are
+// compared per component, with components matched by ID, see
+// DiffDictionaries.
+func (d *Dictionary) Diff(new *Dictionary) (diffs []Diff) {
+	oldConv, newConv := d.LineConvention.orDefault(), new.LineConvention.orDefault()
+	if oldConv != newConv {
+		diffs = append(diffs, Diff{Kind: LineConventionChanged, OldIndex: -1, NewIndex: -1, OldLineConvention: oldConv, NewLineConvention: newConv})
+	}
+	diffs = append(diffs, DiffDictionaries(d.Modules, new.Modules, oldConv, newConv)...)
+
+	oldByID := make(map[uint32]*Component)
+	for i := range d.Components {
+		oldByID[d.Components[i].ID] = &d.Components[i]
+	}
+	newByID := make(map[uint32]*Component)
+	for i := range new.Components {
+		newByID[new.Components[i].ID] = &new.Components[i]
+	}
+
+	ids := make([]uint32, 0, len(oldByID)+len(newByID))
+	for id := range oldByID {
+		ids = append(ids, id)
+	}
+	for id := range newByID {
+		if _, ok := oldByID[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		var (
+			oc, nc                 = oldByID[id], newByID[id]
+			oldModules, newModules []Module
+			cdiffs                 []Diff
+		)
+		if oc != nil {
+			oldModules = oc.Modules
+		}
+		if nc != nil {
+			newModules = nc.Modules
+		}
+		switch {
+		case oc == nil:
+			cdiffs = append(cdiffs, Diff{Kind: ComponentAdded, OldIndex: -1, NewIndex: -1})
+		case nc == nil:
+			cdiffs = append(cdiffs, Diff{Kind: ComponentRemoved, OldIndex: -1, NewIndex: -1})
+		}
+		cdiffs = append(cdiffs, DiffDictionaries(oldModules, newModules, oldConv, newConv)...)
+
+		for i := range cdiffs {
+			id := id
+			cdiffs[i].Component = &id
+		}
+		diffs = append(diffs, cdiffs...)
+	}
+	return
+}
+
+// DiffDictionaries returns the differences between the modules of an old and
+// new dictionary. Modules are matched by name, and a module whose path changed
+// is reported along with any changes to its index.
+//
+// Lines are compared by the line number they output using the old and new
+// line conventions, so a multi-line call whose other line changed is
+// unchanged. Within a module lines that are unchanged are matched first, then
+// lines with the same format string are considered moved, then lines with the
+// same number are considered reworded. Any remaining lines were added or
+// removed. Diffs are sorted by module name, then by line number.
+func DiffDictionaries(old, new []Module, oldConv, newConv LineConvention) (diffs []Diff) {
+	oldByName := make(map[string]*Module)
+	for i := range old {
+		oldByName[old[i].Name] = &old[i]
+	}
+	newByName := make(map[string]*Module)
+	for i := range new {
+		newByName[new[i].Name] = &new[i]
+	}
+
+	names := make([]string, 0, len(oldByName)+len(newByName))
+	for name := range oldByName {
+		names = append(names, name)
+	}
+	for name := range newByName {
+		if _, ok := oldByName[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		om, nm := oldByName[name], newByName[name]
+		switch {
+		case om == nil:
+			diffs = append(diffs, Diff{Kind: ModuleAdded, Module: name, OldIndex: -1, NewIndex: nm.Index})
+			diffs = append(diffs, diffLines(name, -1, nm.Index, nil, nm.Lines, oldConv, newConv)...)
+		case nm == nil:
+			diffs = append(diffs, Diff{Kind: ModuleRemoved, Module: name, OldIndex: om.Index, NewIndex: -1})
+			diffs = append(diffs, diffLines(name, om.Index, -1, om.Lines, nil, oldConv, newConv)...)
+		default:
+			if om.Index != nm.Index {
+				diffs = append(diffs, Diff{Kind: ModuleIndexChanged, Module: name, OldIndex: om.Index, NewIndex: nm.Index})
+			}
+			if om.Path != nm.Path {
+				diffs = append(diffs, Diff{Kind: ModulePathChanged, Module: name, OldIndex: om.Index, NewIndex: nm.Index, OldPath: om.Path, NewPath: nm.Path})
+			}
+			diffs = append(diffs, diffLines(name, om.Index, nm.Index, om.Lines, nm.Lines, oldConv, newConv)...)
+		}
+	}
+	return
+}
+
+func diffLines(module string, oldIndex, newIndex int, old, new []Line, oldConv, newConv LineConvention) (diffs []Diff) {
+	var (
+		oldMatched = make([]bool, len(old))
+		newMatched = make([]bool, len(new))
+		oldNumbers = make([]int, len(old))
+		newNumbers = make([]int, len(new))
+	)
+	for i := range old {
+		oldNumbers[i] = old[i].Output(oldConv)
+	}
+	for j := range new {
+		newNumbers[j] = new[j].Output(newConv)
+	}
+
+	// match pairs up the unmatched lines that are equal
+	match := func(eq func(i, j int) bool) (pairs [][2]int) {
+		for i := range old {
+			if oldMatched[i] {
+				continue
+			}
+			for j := range new {
+				if newMatched[j] || !eq(i, j) {
+					continue
+				}
+				oldMatched[i] = true
+				newMatched[j] = true
+				pairs = append(pairs, [2]int{i, j})
+				break
+			}
+		}
+		return
+	}
+
+	// report reports each pair of lines as a diff of kind
+	report := func(kind DiffKind, pairs [][2]int) {
+		for _, p := range pairs {
+			i, j := p[0], p[1]
+			diffs = append(diffs, Diff{
+				Kind:      kind,
+				Module:    module,
+				OldIndex:  oldIndex,
+				NewIndex:  newIndex,
+				Old:       &old[i],
+				New:       &new[j],
+				OldNumber: oldNumbers[i],
+				NewNumber: newNumbers[j],
+			})
+		}
+	}
+
+	sameFormat := func(i, j int) bool {
+		return old[i].FormatString == new[j].FormatString && old[i].Level == new[j].Level
+	}
+	sameNumber := func(i, j int) bool { return oldNumbers[i] == newNumbers[j] }
+
+	// Unchanged lines aren't reported
+	match(func(i, j int) bool { return sameNumber(i, j) && sameFormat(i, j) })
+	report(LineMoved, match(sameFormat))
+	report(LineReworded, match(sameNumber))
+
+	for i := range old {
+		if !oldMatched[i] {
+			diffs = append(diffs, Diff{Kind: LineRemoved, Module: module, OldIndex: oldIndex, NewIndex: newIndex, Old: &old[i], OldNumber: oldNumbers[i]})
+		}
+	}
+	for j := range new {
+		if !newMatched[j] {
+			diffs = append(diffs, Diff{Kind: LineAdded, Module: module, OldIndex: oldIndex, NewIndex: newIndex, New: &new[j], NewNumber: newNumbers[j]})
+		}
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return diffLineNumber(diffs[i]) < diffLineNumber(diffs[j])
+	})
+	return
+}
+
+func diffLineNumber(d Diff) int {
+	if d.New != nil {
+		return d.NewNumber
+	}
+	return d.OldNumber
+}
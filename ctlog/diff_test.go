@@ -0,0 +1,206 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffDictionaries(t *testing.T) {
+	old := []Module{
+		{
+			Index: 0,
+			Name:  "gpio",
+			Lines: []Line{
+				{Number: 10, Level: LevelInfo, FormatString: "init"},
+				{Number: 20, Level: LevelInfo, FormatString: "pin=%d"},
+				{Number: 30, Level: LevelError, FormatString: "bad pin"},
+				{Number: 40, Level: LevelInfo, FormatString: "removed"},
+			},
+		},
+		{
+			Index: 1,
+			Name:  "main",
+			Path:  "src/main.c",
+			Lines: []Line{
+				{Number: 5, Level: LevelInfo, FormatString: "hello"},
+			},
+		},
+		{
+			Index: 2,
+			Name:  "uart",
+			Path:  "src/uart.c",
+			Lines: []Line{
+				{Number: 7, Level: LevelInfo, FormatString: "baud=%d"},
+			},
+		},
+	}
+	new := []Module{
+		{
+			Index: 0,
+			Name:  "adc",
+			Lines: []Line{
+				{Number: 3, Level: LevelDebug, FormatString: "sample=%d"},
+			},
+		},
+		{
+			Index: 1,
+			Name:  "gpio",
+			Lines: []Line{
+				{Number: 10, Level: LevelInfo, FormatString: "init"},
+				{Number: 20, Level: LevelInfo, FormatString: "pin %d"},
+				{Number: 25, Level: LevelInfo, FormatString: "added"},
+				{Number: 32, Level: LevelError, FormatString: "bad pin"},
+			},
+		},
+		{
+			Index: 2,
+			Name:  "main",
+			Path:  "app/main.c",
+			Lines: []Line{
+				{Number: 5, Level: LevelWarn, FormatString: "hello"},
+			},
+		},
+	}
+
+	var exp = []Diff{
+		{Kind: ModuleAdded, Module: "adc", OldIndex: -1, NewIndex: 0},
+		{Kind: LineAdded, Module: "adc", OldIndex: -1, NewIndex: 0, New: &new[0].Lines[0], NewNumber: 3},
+		{Kind: ModuleIndexChanged, Module: "gpio", OldIndex: 0, NewIndex: 1},
+		{Kind: LineReworded, Module: "gpio", OldIndex: 0, NewIndex: 1, Old: &old[0].Lines[1], New: &new[1].Lines[1], OldNumber: 20, NewNumber: 20},
+		{Kind: LineAdded, Module: "gpio", OldIndex: 0, NewIndex: 1, New: &new[1].Lines[2], NewNumber: 25},
+		{Kind: LineMoved, Module: "gpio", OldIndex: 0, NewIndex: 1, Old: &old[0].Lines[2], New: &new[1].Lines[3], OldNumber: 30, NewNumber: 32},
+		{Kind: LineRemoved, Module: "gpio", OldIndex: 0, NewIndex: 1, Old: &old[0].Lines[3], OldNumber: 40},
+		{Kind: ModuleIndexChanged, Module: "main", OldIndex: 1, NewIndex: 2},
+		{Kind: ModulePathChanged, Module: "main", OldIndex: 1, NewIndex: 2, OldPath: "src/main.c", NewPath: "app/main.c"},
+		{Kind: LineReworded, Module: "main", OldIndex: 1, NewIndex: 2, Old: &old[1].Lines[0], New: &new[2].Lines[0], OldNumber: 5, NewNumber: 5},
+		{Kind: ModuleRemoved, Module: "uart", OldIndex: 2, NewIndex: -1},
+		{Kind: LineRemoved, Module: "uart", OldIndex: 2, NewIndex: -1, Old: &old[2].Lines[0], OldNumber: 7},
+	}
+
+	diffs := DiffDictionaries(old, new, LineEnd, LineEnd)
+	if !reflect.DeepEqual(diffs, exp) {
+		t.Error("data mismatch")
+		for _, d := range diffs {
+			t.Log(d)
+		}
+	}
+
+	if diffs := DiffDictionaries(old, old, LineEnd, LineEnd); len(diffs) != 0 {
+		t.Errorf("expected no differences but got %v", diffs)
+	}
+
+	data, err := json.Marshal(diffs[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d Diff
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, diffs[5]) {
+		t.Errorf("expected %+v but got %+v", diffs[5], d)
+	}
+	if s := d.String(); s != `gpio: line 30 moved to line 32 "bad pin"` {
+		t.Errorf("unexpected string %s", s)
+	}
+}
+
+func TestDictionaryDiff(t *testing.T) {
+	line := func(format string) []Module {
+		return []Module{{Index: 0, Name: "main", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: format}}}}
+	}
+	old := &Dictionary{
+		Modules: []Module{},
+		Components: []Component{
+			{ID: 1, Modules: line("app")},
+			{ID: 2, Modules: line("radio")},
+		},
+	}
+	new := &Dictionary{
+		Modules: []Module{},
+		Components: []Component{
+			{ID: 1, Modules: line("app %d")},
+			{ID: 3, Modules: line("sensor")},
+		},
+	}
+
+	var exp = []string{
+		`component 1: main: line 10 reworded from "app" to "app %d"`,
+		`component 2: removed`,
+		`component 2: main: module removed, was index 0`,
+		`component 2: main: line 10 removed "radio"`,
+		`component 3: added`,
+		`component 3: main: module added with index 0`,
+		`component 3: main: line 10 added "sensor"`,
+	}
+
+	diffs := old.Diff(new)
+	var actual []string
+	for _, d := range diffs {
+		actual = append(actual, d.String())
+	}
+	if !reflect.DeepEqual(actual, exp) {
+		t.Errorf("expected:\n%q\nbut got:\n%q", exp, actual)
+	}
+
+	if diffs := old.Diff(old); len(diffs) != 0 {
+		t.Errorf("expected no differences but got %v", diffs)
+	}
+}
+
+func TestDiffLineConvention(t *testing.T) {
+	module := func(lines ...Line) []Module {
+		return []Module{{Index: 0, Name: "main", Lines: lines}}
+	}
+	old := module(
+		Line{Number: 12, Start: 10, Level: LevelInfo, FormatString: "multi %d"},
+		Line{Number: 20, Level: LevelInfo, FormatString: "single"},
+	)
+	new := module(
+		Line{Number: 13, Start: 10, Level: LevelInfo, FormatString: "multi %d"},
+		Line{Number: 20, Level: LevelInfo, FormatString: "single"},
+	)
+
+	var cases = []struct {
+		Old, New LineConvention
+		Exp      []string
+	}{
+		{
+			Old: LineEnd,
+			New: LineEnd,
+			Exp: []string{`main: line 12 moved to line 13 "multi %d"`},
+		},
+		{
+			Old: LineStart,
+			New: LineStart,
+			Exp: nil,
+		},
+		{
+			Old: "",
+			New: LineStart,
+			Exp: []string{
+				`line convention changed from end to start`,
+				`main: line 12 moved to line 10 "multi %d"`,
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		od := &Dictionary{LineConvention: tc.Old, Modules: old}
+		nd := &Dictionary{LineConvention: tc.New, Modules: new}
+		var actual []string
+		for _, d := range od.Diff(nd) {
+			actual = append(actual, d.String())
+		}
+		if !reflect.DeepEqual(actual, tc.Exp) {
+			t.Errorf("expected:\n%q\nbut got:\n%q", tc.Exp, actual)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// An Encoder writes tokenized logging output in the same format as
+// ctlog_fprintf, ctlog_json_fprintf or ctlog_base64_fprintf, e.g. for
+// simulating devices or testing tools without compiling C.
+//
+// Each Output is written using its Version, which must be Version1 or later
+// to include a component ID, like building with CTLOG_COMPONENT_ID.
+//
+// Like the C code the JSON encoding writes strings byte for byte, so strings
+// that aren't valid UTF-8 won't decode to the same value.
+type Encoder struct {
+	w        io.Writer
+	encoding Encoding
+	buf      []byte
+}
+
+// NewEncoder returns an encoder that writes to w using the given encoding,
+// EncodingTL, EncodingJSON or EncodingBase64.
+func NewEncoder(w io.Writer, encoding Encoding) *Encoder {
+	return &Encoder{
+		w:        w,
+		encoding: encoding,
+	}
+}
+
+// Encode writes output followed by a newline.
+func (e *Encoder) Encode(output *Output) (err error) {
+	switch e.encoding {
+	case EncodingTL:
+		e.buf, err = appendTL(e.buf[:0], output)
+	case EncodingJSON:
+		e.buf, err = appendJSON(e.buf[:0], output, true)
+	case EncodingBase64:
+		e.buf, err = appendBase64(e.buf[:0], output)
+	default:
+		err = fmt.Errorf("unsupported encoding %s", e.encoding)
+	}
+	if err != nil {
+		return
+	}
+	e.buf = append(e.buf, '\n')
+	_, err = e.w.Write(e.buf)
+	return
+}
+
+// checkOutput returns an error if output can't be encoded.
+func checkOutput(output *Output) (err error) {
+	if err = checkVersion(output); err != nil {
+		return
+	}
+	return output.Level.check()
+}
+
+// checkVersion returns an error if output's version or component can't be
+// encoded.
+func checkVersion(output *Output) error {
+	if output.Version > MaxSupportedVersion {
+		return fmt.Errorf("version 0x%02X exceeds max supported version 0x%02X", output.Version, MaxSupportedVersion)
+	}
+	if output.Component != 0 && output.Version < Version1 {
+		return fmt.Errorf("component ID requires version 0x%02X or later", Version1)
+	}
+	return nil
+}
+
+// appendTL appends output in the format written by ctlog_fprintf.
+func appendTL(b []byte, output *Output) ([]byte, error) {
+	if err := checkOutput(output); err != nil {
+		return b, err
+	}
+
+	b = append(b, MagicString...)
+	b = append(b, fmt.Sprintf("%02X,", output.Version)...)
+	if output.Version >= Version1 {
+		b = strconv.AppendUint(b, uint64(output.Component), 10)
+		b = append(b, ',')
+	}
+	b = strconv.AppendUint(b, uint64(output.Sequence), 10)
+	b = append(b, ',', byte(output.Level), ',')
+	b = strconv.AppendUint(b, uint64(output.ModuleIndex), 10)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, uint64(output.LineNumber), 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(len(output.Args)), 10)
+	b = append(b, ',')
+
+	for i, arg := range output.Args {
+		b = strconv.AppendUint(b, uint64(arg.Type), 10)
+		b = append(b, ',')
+
+		var err error
+		switch arg.Type {
+		case TypeBool:
+			v, ok := arg.Value.(bool)
+			if !ok {
+				err = argTypeError(i, arg)
+			} else if v {
+				b = append(b, '1')
+			} else {
+				b = append(b, '0')
+			}
+		case TypeChar:
+			v, ok := arg.Value.(byte)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = strconv.AppendUint(b, uint64(v), 10)
+		case TypeInt:
+			v, ok := arg.Value.(int32)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = strconv.AppendInt(b, int64(v), 10)
+		case TypeString:
+			v, ok := arg.Value.(string)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = append(b, '^', '\x00')
+			b = append(b, v...)
+			b = append(b, '$', '\x00')
+		case TypeUint:
+			v, ok := arg.Value.(uint32)
+			if !ok {
+				err = argTypeError(i, arg)
+			}
+			b = strconv.AppendUint(b, uint64(v), 10)
+		default:
+			err = fmt.Errorf("unsupported argument %d type %d", i, arg.Type)
+		}
+		if err != nil {
+			return b, err
+		}
+		b = append(b, ',')
+	}
+
+	return b, nil
+}
+
+// appendJSON appends output in the format written by ctlog_json_fprintf. If
+// raw is true characters are written byte for byte like the C code, else
+// bytes that aren't valid UTF-8, including characters that aren't ASCII, are
+// escaped as \u00XX so they decode to the same bytes.
+func appendJSON(b []byte, output *Output, raw bool) ([]byte, error) {
+	// Output.MarshalJSON allows the zero level of a text record, it's
+	// output as ""
+	check := checkOutput
+	if !raw && output.Level == 0 {
+		check = checkVersion
+	}
+	if err := check(output); err != nil {
+		return b, err
+	}
+
+	b = append(b, `{"ctlog":`...)
+	b = strconv.AppendUint(b, uint64(output.Version), 10)
+	b = append(b, ',')
+	if output.Version >= Version1 {
+		b = append(b, `"cid":`...)
+		b = strconv.AppendUint(b, uint64(output.Component), 10)
+		b = append(b, ',')
+	}
+	b = append(b, `"seq":`...)
+	b = strconv.AppendUint(b, uint64(output.Sequence), 10)
+	b = append(b, `,"lvl":"`...)
+	if output.Level != 0 {
+		b = append(b, byte(output.Level))
+	}
+	b = append(b, `","mi":`...)
+	b = strconv.AppendUint(b, uint64(output.ModuleIndex), 10)
+	b = append(b, `,"ml":`...)
+	b = strconv.AppendUint(b, uint64(output.LineNumber), 10)
+	b = append(b, `,"args":[`...)
+
+	for i, arg := range output.Args {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		var err error
+		if b, err = appendJSONArg(b, i, arg, raw); err != nil {
+			return b, err
+		}
+	}
+
+	return append(b, "]}"...), nil
+}
+
+// appendJSONArg appends an argument in the format written by
+// ctlog_json_fprintf, see appendJSON.
+func appendJSONArg(b []byte, i int, arg Arg, raw bool) (_ []byte, err error) {
+	b = append(b, `{"t":`...)
+	b = strconv.AppendUint(b, uint64(arg.Type), 10)
+	b = append(b, `,"v":`...)
+
+	switch arg.Type {
+	case TypeBool:
+		v, ok := arg.Value.(bool)
+		if !ok {
+			err = argTypeError(i, arg)
+		}
+		b = strconv.AppendBool(b, v)
+	case TypeChar:
+		v, ok := arg.Value.(byte)
+		if !ok {
+			err = argTypeError(i, arg)
+		}
+		b = append(b, '"')
+		if v >= 0x80 && !raw {
+			b = append(b, fmt.Sprintf(`\u%04X`, v)...)
+		} else {
+			b = appendJSONByte(b, v)
+		}
+		b = append(b, '"')
+	case TypeInt:
+		v, ok := arg.Value.(int32)
+		if !ok {
+			err = argTypeError(i, arg)
+		}
+		b = strconv.AppendInt(b, int64(v), 10)
+	case TypeString:
+		v, ok := arg.Value.(string)
+		if !ok {
+			err = argTypeError(i, arg)
+		}
+		b = append(b, '"')
+		for j := 0; j < len(v); {
+			r, size := utf8.DecodeRuneInString(v[j:])
+			if r == utf8.RuneError && size == 1 && !raw {
+				b = append(b, fmt.Sprintf(`\u%04X`, v[j])...)
+			} else {
+				for k := j; k < j+size; k++ {
+					b = appendJSONByte(b, v[k])
+				}
+			}
+			j += size
+		}
+		b = append(b, '"')
+	case TypeUint:
+		v, ok := arg.Value.(uint32)
+		if !ok {
+			err = argTypeError(i, arg)
+		}
+		b = strconv.AppendUint(b, uint64(v), 10)
+	default:
+		err = fmt.Errorf("unsupported argument %d type %d", i, arg.Type)
+	}
+	return append(b, '}'), err
+}
+
+// appendJSONByte escapes a byte the same way as ctlog_fputc_json.
+func appendJSONByte(b []byte, c byte) []byte {
+	switch {
+	case c == '"' || c == '\\':
+		return append(b, '\\', c)
+	case c == '\b':
+		return append(b, '\\', 'b')
+	case c == '\f':
+		return append(b, '\\', 'f')
+	case c == '\n':
+		return append(b, '\\', 'n')
+	case c == '\r':
+		return append(b, '\\', 'r')
+	case c == '\t':
+		return append(b, '\\', 't')
+	case c < 0x20 || c == 0x7F:
+		return append(b, fmt.Sprintf(`\u%04X`, c)...)
+	default:
+		return append(b, c)
+	}
+}
+
+func argTypeError(i int, arg Arg) error {
+	return fmt.Errorf("argument %d has type %d but its value is a %T", i, arg.Type, arg.Value)
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var encoderArgs = []Arg{
+	{Type: TypeBool, Value: true},
+	{Type: TypeChar, Value: byte(1)},
+	{Type: TypeInt, Value: int32(-2147483648)},
+	{Type: TypeString, Value: "q\"b\\s/\x7f\x1f\ttab\nnl"},
+	{Type: TypeUint, Value: uint32(4294967295)},
+}
+
+func TestEncoder(t *testing.T) {
+	// Expected output was generated by ctlog_fprintf, ctlog_json_fprintf and
+	// ctlog_base64_fprintf
+	var cases = []struct {
+		Encoding Encoding
+		Output   Output
+		Exp      string
+	}{
+		{
+			Encoding: EncodingTL,
+			Output:   Output{Sequence: 0, Level: LevelInfo, ModuleIndex: 3, LineNumber: 42, Args: encoderArgs},
+			Exp:      "$TL00,0,I,3,42,5,0,1,1,1,2,-2147483648,3,^\x00q\"b\\s/\x7f\x1f\ttab\nnl$\x00,4,4294967295,\n",
+		},
+		{
+			Encoding: EncodingJSON,
+			Output:   Output{Sequence: 1, Level: LevelWarn, ModuleIndex: 3, LineNumber: 42, Args: encoderArgs},
+			Exp:      `{"ctlog":0,"seq":1,"lvl":"W","mi":3,"ml":42,"args":[{"t":0,"v":true},{"t":1,"v":"\u0001"},{"t":2,"v":-2147483648},{"t":3,"v":"q\"b\\s/\u007F\u001F\ttab\nnl"},{"t":4,"v":4294967295}]}` + "\n",
+		},
+		{
+			Encoding: EncodingTL,
+			Output:   Output{Sequence: 2, Level: LevelError, ModuleIndex: 0, LineNumber: 1},
+			Exp:      "$TL00,2,E,0,1,0,\n",
+		},
+		{
+			Encoding: EncodingJSON,
+			Output:   Output{Sequence: 3, Level: LevelDebug, ModuleIndex: 0, LineNumber: 1},
+			Exp:      `{"ctlog":0,"seq":3,"lvl":"D","mi":0,"ml":1,"args":[]}` + "\n",
+		},
+		{
+			Encoding: EncodingTL,
+			Output:   Output{Version: Version1, Component: 7, Sequence: 2, Level: LevelError, ModuleIndex: 0, LineNumber: 1},
+			Exp:      "$TL01,7,2,E,0,1,0,\n",
+		},
+		{
+			Encoding: EncodingJSON,
+			Output:   Output{Version: Version1, Component: 7, Sequence: 4, Level: LevelInfo, ModuleIndex: 1, LineNumber: 2, Args: []Arg{{Type: TypeChar, Value: byte('"')}, {Type: TypeBool, Value: false}}},
+			Exp:      `{"ctlog":1,"cid":7,"seq":4,"lvl":"I","mi":1,"ml":2,"args":[{"t":1,"v":"\""},{"t":0,"v":false}]}` + "\n",
+		},
+		{
+			Encoding: EncodingBase64,
+			Output:   Output{Sequence: 5, Level: LevelInfo, ModuleIndex: 3, LineNumber: 42, Args: encoderArgs},
+			Exp:      "~AAVJAyoFAAEBAQL/////DwMPcSJiXHMvfx8JdGFiCm5sBP////8P\n",
+		},
+		{
+			Encoding: EncodingBase64,
+			Output:   Output{Version: Version1, Component: 7, Sequence: 2, Level: LevelError, ModuleIndex: 0, LineNumber: 1},
+			Exp:      "~AQcCRQABAA\n",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, tc.Encoding).Encode(&tc.Output); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tc.Exp {
+			t.Errorf("expected %q but got %q", tc.Exp, buf.String())
+		}
+
+		// Decoding the output must give back the same values
+		rec, err := NewDecoder(&buf).Next()
+		if err != nil {
+			t.Fatalf("unexpected error decoding: %v", err)
+		}
+		if rec.Encoding != tc.Encoding {
+			t.Errorf("expected %s encoding but got %s", tc.Encoding, rec.Encoding)
+		}
+		if len(rec.Output.Args) == 0 && len(tc.Output.Args) == 0 {
+			rec.Output.Args = tc.Output.Args
+		}
+		if !reflect.DeepEqual(rec.Output, tc.Output) {
+			t.Errorf("expected %+v but got %+v", tc.Output, rec.Output)
+		}
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	var args []Arg
+	for c := 0; c < 256; c++ {
+		args = append(args, Arg{Type: TypeChar, Value: byte(c)})
+	}
+	for _, b := range []bool{false, true} {
+		args = append(args, Arg{Type: TypeBool, Value: b})
+	}
+	for _, n := range []int32{-2147483648, -1, 0, 1, 2147483647} {
+		args = append(args, Arg{Type: TypeInt, Value: n})
+	}
+	for _, n := range []uint32{0, 1, 4294967295} {
+		args = append(args, Arg{Type: TypeUint, Value: n})
+	}
+	for _, s := range []string{"", "hello, world", "a\r\nb", "^$,", "\x00", "unicode é世"} {
+		args = append(args, Arg{Type: TypeString, Value: s})
+	}
+
+	// Split the arguments into outputs since the $TL format only allows 255
+	for i := 0; i < len(args); i += 100 {
+		end := i + 100
+		if end > len(args) {
+			end = len(args)
+		}
+		exp := Output{Sequence: uint16(i), Level: LevelInfo, ModuleIndex: 1, LineNumber: 2, Args: args[i:end]}
+
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, EncodingTL).Encode(&exp); err != nil {
+			t.Fatal(err)
+		}
+		out, ok, err := ParseOutput(bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}))
+		if err != nil || !ok {
+			t.Fatalf("failed to parse $TL output: %v", err)
+		}
+		if !reflect.DeepEqual(*out, exp) {
+			t.Errorf("$TL round trip mismatch:\n%+v\n%+v", exp, *out)
+		}
+
+		buf.Reset()
+		if err := NewEncoder(&buf, EncodingBase64).Encode(&exp); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := NewDecoder(&buf).Next()
+		if err != nil {
+			t.Fatalf("failed to decode base64 output: %v", err)
+		}
+		if !reflect.DeepEqual(rec.Output, exp) {
+			t.Errorf("base64 round trip mismatch:\n%+v\n%+v", exp, rec.Output)
+		}
+
+		// The JSON encoding can't round trip characters that aren't valid
+		// UTF-8 on their own
+		var jsonArgs []Arg
+		for _, arg := range exp.Args {
+			if c, ok := arg.Value.(byte); !ok || c < 0x80 {
+				jsonArgs = append(jsonArgs, arg)
+			}
+		}
+		exp.Args = jsonArgs
+
+		buf.Reset()
+		if err := NewEncoder(&buf, EncodingJSON).Encode(&exp); err != nil {
+			t.Fatal(err)
+		}
+		var jsonOut Output
+		if err := json.Unmarshal(buf.Bytes(), &jsonOut); err != nil {
+			t.Fatalf("failed to unmarshal JSON output: %v", err)
+		}
+		if !reflect.DeepEqual(jsonOut, exp) {
+			t.Errorf("JSON round trip mismatch:\n%+v\n%+v", exp, jsonOut)
+		}
+	}
+}
+
+func TestEncoderErrors(t *testing.T) {
+	var cases = []struct {
+		Encoding Encoding
+		Output   Output
+	}{
+		{Encoding: EncodingTL, Output: Output{Level: LevelInfo, Args: []Arg{{Type: TypeUint, Value: 5}}}},
+		{Encoding: EncodingJSON, Output: Output{Level: LevelInfo, Args: []Arg{{Type: Type(9), Value: uint32(5)}}}},
+		{Encoding: EncodingTL, Output: Output{Level: Level('X')}},
+		{Encoding: EncodingTL, Output: Output{Component: 1, Level: LevelInfo}},
+		{Encoding: EncodingBase64, Output: Output{Level: LevelInfo, Args: []Arg{{Type: TypeInt, Value: 5}}}},
+		{Encoding: EncodingBase64, Output: Output{Level: Level('X')}},
+		{Encoding: EncodingText, Output: Output{Level: LevelInfo}},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		if err := NewEncoder(new(bytes.Buffer), tc.Encoding).Encode(&tc.Output); err == nil {
+			t.Error("expected error")
+		}
+	}
+}
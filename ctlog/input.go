@@ -0,0 +1,275 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StdinName is the input name that refers to stdin.
+const StdinName = "-"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ExpandInputs expands each glob pattern into the names of the files it
+// matches, in order. StdinName and names without glob characters are kept as
+// is, a pattern that doesn't match anything is an error.
+func ExpandInputs(patterns []string) (names []string, err error) {
+	for _, pattern := range patterns {
+		if pattern == StdinName || !strings.ContainsAny(pattern, `*?[\`) {
+			names = append(names, pattern)
+			continue
+		}
+
+		var matches []string
+		matches, err = filepath.Glob(pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			return
+		}
+		if len(matches) == 0 {
+			err = fmt.Errorf("no files match '%s'", pattern)
+			return
+		}
+		names = append(names, matches...)
+	}
+	return
+}
+
+// OpenInput opens the named file, or stdin for StdinName, for reading
+// output. gzip and zstd compressed input is decompressed, zstd using the
+// zstd command. Live input, see IsLiveInput, is never decompressed, so
+// reading doesn't wait for the first output to check it.
+func OpenInput(name string) (rc io.ReadCloser, err error) {
+	var f *os.File
+	if name == StdinName {
+		f = os.Stdin
+	} else if f, err = os.Open(name); err != nil {
+		return
+	}
+
+	rc, err = decompress(f)
+	if err != nil && f != os.Stdin {
+		f.Close()
+	}
+	return
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
+
+// decompress detects whether the input is compressed and returns a reader
+// for the decompressed input. Closing it closes f.
+func decompress(f *os.File) (rc io.ReadCloser, err error) {
+	if fi, serr := f.Stat(); serr == nil && isLive(fi) {
+		rc = f
+		return
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		rc = readCloser{zr, func() error {
+			zr.Close()
+			return f.Close()
+		}}
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		cmd := exec.Command("zstd", "-dc")
+		cmd.Stdin = br
+		cmd.Stderr = os.Stderr
+		var out io.ReadCloser
+		if out, err = cmd.StdoutPipe(); err != nil {
+			return
+		}
+		if err = cmd.Start(); err != nil {
+			err = fmt.Errorf("error starting zstd to decompress input: %v", err)
+			return
+		}
+		rc = readCloser{out, func() error {
+			// Stop zstd if the output isn't read to the end
+			out.Close()
+			cmd.Wait()
+			return f.Close()
+		}}
+
+	default:
+		rc = readCloser{br, f.Close}
+	}
+	return
+}
+
+// IsLiveInput returns true if the named input, or stdin for StdinName, may be
+// live output, i.e. it's a terminal, serial port, pipe or socket rather than
+// a file, so it should be decoded and written a line at a time.
+func IsLiveInput(name string) bool {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	if name == StdinName {
+		fi, err = os.Stdin.Stat()
+	} else {
+		fi, err = os.Stat(name)
+	}
+	return err != nil || isLive(fi)
+}
+
+func isLive(fi os.FileInfo) bool {
+	return fi.Mode()&(os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0
+}
+
+// DefaultPollInterval is the default interval a Follower checks a file for
+// more output.
+const DefaultPollInterval = 250 * time.Millisecond
+
+// A Follower reads a file that is still being written, like tail -F. At the
+// end of the file it waits for more output instead of returning io.EOF, and
+// if the file is replaced, e.g. by log rotation, or truncated it starts
+// reading again from the beginning of the new file.
+type Follower struct {
+	// PollInterval is how often the file is checked for more output at the
+	// end of the file. If zero DefaultPollInterval is used.
+	PollInterval time.Duration
+
+	name string
+	f    *os.File
+
+	mu        sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Follow opens the named file to be followed from its beginning.
+func Follow(name string) (fl *Follower, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	fl = &Follower{
+		name:   name,
+		f:      f,
+		closed: make(chan struct{}),
+	}
+	return
+}
+
+// Read reads from the file, blocking until there is more output or the
+// follower is closed, in which case it returns io.EOF.
+func (fl *Follower) Read(p []byte) (n int, err error) {
+	interval := fl.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	for {
+		fl.mu.Lock()
+		if fl.f == nil {
+			fl.mu.Unlock()
+			return 0, io.EOF
+		}
+		n, err = fl.f.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			fl.mu.Unlock()
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		prev := fl.f
+		err = fl.reopen()
+		reopened := fl.f != prev
+		fl.mu.Unlock()
+		if err != nil {
+			return
+		} else if reopened {
+			continue
+		}
+
+		select {
+		case <-fl.closed:
+			return 0, io.EOF
+		case <-time.After(interval):
+		}
+	}
+}
+
+// reopen reopens the file if it has been replaced or seeks to its beginning
+// if it has been truncated. It must be called at the end of the file with
+// fl.mu held.
+func (fl *Follower) reopen() (err error) {
+	cur, err := fl.f.Stat()
+	if err != nil {
+		return
+	}
+	var pos int64
+	if pos, err = fl.f.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+	if cur.Size() < pos {
+		_, err = fl.f.Seek(0, io.SeekStart)
+		return
+	} else if cur.Size() > pos {
+		// Finish reading the file even if it's been replaced
+		return
+	}
+
+	fi, err := os.Stat(fl.name)
+	if os.IsNotExist(err) {
+		// Wait for the file to be recreated
+		err = nil
+		return
+	} else if err != nil || os.SameFile(cur, fi) {
+		return
+	}
+
+	f, err := os.Open(fl.name)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	fl.f.Close()
+	fl.f = f
+	return
+}
+
+// Close stops following the file, any blocked Read returns io.EOF.
+func (fl *Follower) Close() (err error) {
+	fl.closeOnce.Do(func() {
+		close(fl.closed)
+		fl.mu.Lock()
+		err = fl.f.Close()
+		fl.f = nil
+		fl.mu.Unlock()
+	})
+	return
+}
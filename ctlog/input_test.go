@@ -0,0 +1,240 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.log", "b.log", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cases = []struct {
+		Patterns []string
+		Exp      []string
+		Err      bool
+	}{
+		{
+			Patterns: []string{"-"},
+			Exp:      []string{"-"},
+		},
+		{
+			Patterns: []string{filepath.Join(dir, "c.txt"), filepath.Join(dir, "*.log"), "-"},
+			Exp:      []string{filepath.Join(dir, "c.txt"), filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log"), "-"},
+		},
+		{
+			Patterns: []string{filepath.Join(dir, "missing")},
+			Exp:      []string{filepath.Join(dir, "missing")},
+		},
+		{
+			Patterns: []string{filepath.Join(dir, "*.gz")},
+			Err:      true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		names, err := ExpandInputs(tc.Patterns)
+		if tc.Err {
+			if err == nil {
+				t.Error("expected error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(names, tc.Exp) {
+			t.Errorf("expected %v but got %v", tc.Exp, names)
+		}
+	}
+}
+
+func TestOpenInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exp := []byte("booting\n$TL00,0,I,0,10,1,4,1,\n")
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(exp)
+	zw.Close()
+
+	files := map[string][]byte{
+		"plain.log":  exp,
+		"output.gz":  gz.Bytes(),
+		"short.log":  []byte("x"),
+		"empty.log":  nil,
+		"output.zst": nil,
+	}
+	if zstd, err := exec.LookPath("zstd"); err == nil {
+		cmd := exec.Command(zstd, "-c")
+		cmd.Stdin = bytes.NewReader(exp)
+		if files["output.zst"], err = cmd.Output(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		delete(files, "output.zst")
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, data := range files {
+		t.Logf("Test case %s", name)
+
+		rc, err := OpenInput(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		actual, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic) {
+			data = exp
+		}
+		if !bytes.Equal(actual, data) {
+			t.Errorf("expected %q but got %q", data, actual)
+		}
+	}
+}
+
+func TestDecompressLive(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+
+	// Nothing has been written yet, so checking for compression would block
+	done := make(chan error, 1)
+	go func() {
+		rc, err := decompress(pr)
+		if err == nil {
+			rc.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decompress blocked on a pipe without output")
+	}
+}
+
+func TestFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "output.log")
+	if err := ioutil.WriteFile(name, []byte("one\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	fl, err := Follow(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl.PollInterval = time.Millisecond
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(fl)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	next := func(exp string) {
+		select {
+		case line := <-lines:
+			if line != exp {
+				t.Errorf("expected line %q but got %q", exp, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line %q", exp)
+		}
+	}
+	appendFile := func(data string) {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+
+	next("one")
+
+	appendFile("two\npar")
+	next("two")
+	appendFile("tial\n")
+	next("partial")
+
+	// Output written just before rotating is still read from the old file
+	appendFile("three\n")
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile("rotated\n")
+	next("three")
+	next("rotated")
+
+	if err := os.Truncate(name, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the truncation to be seen before writing more
+	time.Sleep(50 * time.Millisecond)
+	appendFile("truncated\n")
+	next("truncated")
+
+	fl.Close()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Error("expected no more lines after closing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the follower to close")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MergeDictionaries merges the dictionaries of firmware components that share
+// an output into one dictionary, with each component's modules namespaced
+// under its component ID. The merged dictionary is dated with the latest of
+// the components' dates.
+func MergeDictionaries(dicts map[uint32]*Dictionary) (merged *Dictionary, err error) {
+	ids := make([]uint32, 0, len(dicts))
+	for id := range dicts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	merged = new(Dictionary)
+	for _, id := range ids {
+		dict := dicts[id]
+		if len(dict.Components) > 0 {
+			err = fmt.Errorf("component %d: dictionary is already merged", id)
+			return
+		}
+		if len(merged.Components) == 0 {
+			merged.LineConvention = dict.LineConvention
+		} else if merged.LineConvention.orDefault() != dict.LineConvention.orDefault() {
+			err = fmt.Errorf("component %d: line convention '%s' differs from the other components", id, dict.LineConvention.orDefault())
+			return
+		}
+		if dict.Date.After(merged.Date) {
+			merged.Date = dict.Date
+		}
+		merged.Components = append(merged.Components, Component{
+			ID:      id,
+			BuildID: dict.Fingerprint(),
+			Modules: dict.Modules,
+		})
+	}
+	merged.Modules = []Module{}
+	merged.BuildID = merged.Fingerprint()
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeDictionaries(t *testing.T) {
+	app := &Dictionary{
+		Date:           time.Date(2018, 6, 28, 0, 0, 0, 0, time.UTC),
+		LineConvention: LineStart,
+		Modules:        []Module{{Index: 0, Name: "main", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "app=%d"}}}},
+	}
+	radio := &Dictionary{
+		Date:           time.Date(2018, 7, 28, 0, 0, 0, 0, time.UTC),
+		LineConvention: LineStart,
+		Modules:        []Module{{Index: 0, Name: "main", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "radio=%d"}}}},
+	}
+
+	merged, err := MergeDictionaries(map[uint32]*Dictionary{2: radio, 1: app})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Components) != 2 || merged.Components[0].ID != 1 || merged.Components[1].ID != 2 {
+		t.Fatalf("unexpected components %+v", merged.Components)
+	}
+	if !merged.Date.Equal(radio.Date) {
+		t.Errorf("expected latest date, got %v", merged.Date)
+	}
+	if merged.Components[0].BuildID != app.Fingerprint() {
+		t.Error("expected component build ID to be the build ID its device prints")
+	}
+	if merged.BuildID != merged.Fingerprint() || merged.BuildID == Fingerprint(nil) {
+		t.Errorf("unexpected build ID %s", merged.BuildID)
+	}
+
+	tx := NewDictionaryTranslator(merged)
+	for _, tc := range []struct {
+		Component uint32
+		Exp       string
+		ExpectErr bool
+	}{
+		{Component: 1, Exp: "app=5"},
+		{Component: 2, Exp: "radio=5"},
+		{Component: 3, ExpectErr: true},
+	} {
+		s, err := tx.Translate(&Output{
+			Component:  tc.Component,
+			LineNumber: 10,
+			Args:       []Arg{{Type: TypeUint, Value: uint32(5)}},
+		})
+		if err != nil {
+			if !tc.ExpectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		} else if tc.ExpectErr {
+			t.Errorf("component %d: expected error", tc.Component)
+		} else if s != tc.Exp {
+			t.Errorf("component %d: expected %q but got %q", tc.Component, tc.Exp, s)
+		}
+	}
+
+	if _, err := MergeDictionaries(map[uint32]*Dictionary{1: merged}); err == nil {
+		t.Error("expected error merging a merged dictionary")
+	}
+
+	// An unset line convention is the same as LineEnd
+	unset := &Dictionary{Modules: app.Modules}
+	end := &Dictionary{LineConvention: LineEnd, Modules: radio.Modules}
+	if _, err := MergeDictionaries(map[uint32]*Dictionary{1: unset, 2: end}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := MergeDictionaries(map[uint32]*Dictionary{1: app, 2: end}); err == nil {
+		t.Error("expected error merging different line conventions")
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultChunkLines is the default number of lines decoded together by a
+// Pipeline worker.
+const DefaultChunkLines = 1024
+
+// A Pipeline decodes tokenized logging output using multiple goroutines while
+// preserving the order of the output. One goroutine splits the input into
+// chunks of lines using ScanLines, workers translate each chunk, and the
+// chunks are written in their original order.
+type Pipeline struct {
+	// Translator translates each tokenized logging line, lines that aren't
+	// tokenized are output as is.
+	Translator *Translator
+
+	// Workers is the number of chunks decoded in parallel. If zero the number
+	// of CPUs is used.
+	Workers int
+
+	// ChunkLines is the number of lines in each chunk. If zero
+	// DefaultChunkLines is used.
+	ChunkLines int
+
+	// MaxPending is the number of chunks that may be read ahead of the chunk
+	// being written before reading blocks. If zero twice the number of
+	// workers is used.
+	MaxPending int
+
+	// MaxLineSize is the maximum size of a line in bytes, see
+	// Decoder.MaxLineSize.
+	MaxLineSize int
+
+	// Discarded is set by Decode to the number of bytes of noise and
+	// truncated lines that were discarded, see Decoder. It isn't set if
+	// Decode returns an error.
+	Discarded int64
+
+	// OnError, if set, makes decoding lenient. Lines that can't be decoded
+	// are written as is, and tokenized lines that can't be translated are
+	// written using FormatUnknown. OnError is called in input order with the
+	// line number and error, either a *SyntaxError or *TranslateError, of
+	// each of these lines.
+	OnError func(line int, err error)
+
+	// StrictTranslate, if set along with OnError, stops decoding at the first
+	// tokenized line that can't be translated. Lines that can't be decoded are
+	// still written as is.
+	StrictTranslate bool
+}
+
+type pipelineChunk struct {
+	data    []byte
+	ends    []int   // end offset of each line in data
+	lines   []int   // line number of each line in the input
+	offsets []int64 // offset of each line in the input
+
+	out   []byte
+	err   error
+	errs  []LineError // errors skipped
+	ready chan struct{}
+}
+
+// A LineError is returned by Pipeline.Decode when a tokenized line can't be
+// translated. Err is the *TranslateError.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Decode decodes the tokenized logging output read from r and writes each
+// line to w. Unless OnError is set it stops at the first line that can't be
+// decoded, after writing the lines before it, and returns a *SyntaxError or
+// *LineError.
+//
+// Lines are written a chunk at a time, so Decode is meant for input that ends
+// such as files rather than live output. If it returns an error it doesn't
+// wait for a read from r that's blocked, the goroutines reading and decoding
+// r exit once it returns.
+func (p *Pipeline) Decode(r io.Reader, w io.Writer) (err error) {
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	chunkLines := p.ChunkLines
+	if chunkLines <= 0 {
+		chunkLines = DefaultChunkLines
+	}
+	maxPending := p.MaxPending
+	if maxPending <= 0 {
+		maxPending = 2 * workers
+	}
+
+	var (
+		jobs    = make(chan *pipelineChunk)
+		pending = make(chan *pipelineChunk, maxPending)
+		done    = make(chan struct{})
+		readErr = make(chan error, 1)
+		wg      sync.WaitGroup
+	)
+
+	// Use a decoder to split lines and keep track of where each one starts
+	d := NewDecoder(r)
+	d.MaxLineSize = p.MaxLineSize
+
+	// The workers may outlive Decode, so they don't use p
+	var (
+		tx               = p.Translator
+		lenientSyntax    = p.OnError != nil
+		lenientTranslate = lenientSyntax && !p.StrictTranslate
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out Output
+			for c := range jobs {
+				c.translate(tx, &out, lenientSyntax, lenientTranslate)
+				close(c.ready)
+			}
+		}()
+	}
+
+	// Split the input into chunks. Chunks are queued for writing before
+	// they're handed to a worker, so reading blocks once too many are
+	// waiting to be written.
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+
+		send := func(c *pipelineChunk) bool {
+			select {
+			case pending <- c:
+			case <-done:
+				return false
+			}
+			select {
+			case jobs <- c:
+			case <-done:
+				close(c.ready)
+				return false
+			}
+			return true
+		}
+
+		c := &pipelineChunk{ready: make(chan struct{})}
+		for d.scan() {
+			c.data = append(c.data, d.data...)
+			c.ends = append(c.ends, len(c.data))
+			c.lines = append(c.lines, d.recLine)
+			c.offsets = append(c.offsets, d.recOffset)
+			if len(c.ends) == chunkLines {
+				if !send(c) {
+					readErr <- nil
+					return
+				}
+				c = &pipelineChunk{ready: make(chan struct{})}
+			}
+		}
+		if len(c.ends) > 0 && !send(c) {
+			readErr <- nil
+			return
+		}
+		readErr <- d.s.Err()
+	}()
+
+	for c := range pending {
+		<-c.ready
+		// The lines before an error are still written
+		if _, err = w.Write(c.out); err != nil {
+			break
+		}
+		for _, e := range c.errs {
+			p.OnError(e.Line, e.Err)
+		}
+		if c.err != nil {
+			err = c.err
+			break
+		}
+	}
+
+	// Stop reading if there was an error. The reader may be blocked reading
+	// r so it isn't waited for.
+	close(done)
+	if err != nil {
+		return
+	}
+	wg.Wait()
+
+	if rerr := <-readErr; rerr != nil {
+		err = fmt.Errorf("error reading input: %v", rerr)
+		return
+	}
+	p.Discarded = d.Discarded()
+	return
+}
+
+func (c *pipelineChunk) translate(tx *Translator, out *Output, lenientSyntax, lenientTranslate bool) {
+	start := 0
+	for i, end := range c.ends {
+		line := c.data[start:end]
+		start = end
+
+		enc, recStart, recEnd, err := decodeLine(line, out)
+		if err != nil {
+			err = &SyntaxError{
+				Encoding: enc,
+				Offset:   c.offsets[i],
+				Line:     c.lines[i],
+				Err:      err,
+			}
+			if !lenientSyntax {
+				c.err = err
+				return
+			}
+			c.errs = append(c.errs, LineError{c.lines[i], err})
+			c.out = append(c.out, line...)
+		} else if enc == EncodingText {
+			c.out = append(c.out, line...)
+		} else if s, err := tx.Translate(out); err != nil {
+			if !lenientTranslate {
+				c.err = &LineError{c.lines[i], err}
+				return
+			}
+			c.errs = append(c.errs, LineError{c.lines[i], err})
+			c.out = append(c.out, line[:recStart]...)
+			c.out = append(c.out, FormatUnknown(out)...)
+			c.out = append(c.out, line[recEnd:]...)
+		} else {
+			// Keep any text around the record
+			c.out = append(c.out, line[:recStart]...)
+			c.out = append(c.out, s...)
+			c.out = append(c.out, line[recEnd:]...)
+		}
+		c.out = append(c.out, '\n')
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pipelineModules = []Module{
+	{
+		Index: 0,
+		Name:  "main",
+		Lines: []Line{
+			{Number: 10, FormatString: "count=%d"},
+			{Number: 20, FormatString: "name=%s"},
+		},
+	},
+}
+
+func TestPipeline(t *testing.T) {
+	var (
+		input bytes.Buffer
+		exp   bytes.Buffer
+	)
+	for i := 0; i < 1000; i++ {
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&input, "$TL00,%d,I,0,10,1,4,%d,\n", i, i)
+			fmt.Fprintf(&exp, "count=%d\n", i)
+		case 1:
+			fmt.Fprintf(&input, "$TL00,%d,I,0,20,1,3,^\x00multi\nline %d$\x00,\n", i, i)
+			fmt.Fprintf(&exp, "name=multi\nline %d\n", i)
+		case 2:
+			fmt.Fprintf(&input, `{"ctlog":0,"seq":%d,"lvl":"I","mi":0,"ml":10,"args":[{"t":4,"v":%d}]}`+"\n", i, i)
+			fmt.Fprintf(&exp, "count=%d\n", i)
+		case 3:
+			fmt.Fprintf(&input, "plain text %d\n", i)
+			fmt.Fprintf(&exp, "plain text %d\n", i)
+		}
+	}
+
+	var cases = []Pipeline{
+		{Workers: 1, ChunkLines: 1},
+		{Workers: 4, ChunkLines: 3, MaxPending: 1},
+		{Workers: 8, ChunkLines: 7},
+		{},
+	}
+
+	for i, p := range cases {
+		t.Logf("Test case %d", i)
+
+		p.Translator = NewTranslator(pipelineModules)
+		var out bytes.Buffer
+		if err := p.Decode(bytes.NewReader(input.Bytes()), &out); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.String() != exp.String() {
+			t.Error("output mismatch")
+		}
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	input := strings.Repeat("$TL00,0,I,0,10,1,4,1,\n", 50) + "$TL00,0,I,0,30,0,\n" + strings.Repeat("text\n", 50)
+
+	p := Pipeline{
+		Translator: NewTranslator(pipelineModules),
+		Workers:    4,
+		ChunkLines: 4,
+	}
+	err := p.Decode(strings.NewReader(input), new(bytes.Buffer))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 51:") {
+		t.Errorf("expected line 51 error but got %v", err)
+	}
+
+	err = p.Decode(strings.NewReader(strings.Repeat("text\n", 100)), failingWriter{})
+	if err != errWriteFailed {
+		t.Errorf("expected write error but got %v", err)
+	}
+}
+
+func TestPipelineErrorBlockedRead(t *testing.T) {
+	// The writer is never closed, so reading blocks after the invalid line
+	pr, pw := io.Pipe()
+	go fmt.Fprint(pw, "$TL00,0,I,0,10,1,4,1,\n$TL00,0,I,0,30,0,\n")
+
+	p := Pipeline{
+		Translator: NewTranslator(pipelineModules),
+		Workers:    2,
+		ChunkLines: 1,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.Decode(pr, new(bytes.Buffer))
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("expected line 2 error but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decode didn't return while reading was blocked")
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWriteFailed
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	var input bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&input, "$TL00,%d,I,0,20,1,3,^\x00value %d$\x00,\n", i%65536, i)
+	}
+
+	p := Pipeline{Translator: NewTranslator(pipelineModules)}
+	b.SetBytes(int64(input.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.Decode(bytes.NewReader(input.Bytes()), new(bytes.Buffer)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPipelineLenient(t *testing.T) {
+	input := "$TL00,0,I,0,10,1,4,1,\n" +
+		"$TL00,1,I,7,88,2,4,5,3,^\x00idle$\x00,\n" +
+		"$TL00,2,I,0,10,1,4,x,\n" +
+		"text\n" +
+		"$TL00,3,I,0,99,0,\n"
+	exp := "count=1\n" +
+		"<unknown token mi=7 ml=88 args=[5 \"idle\"]>\n" +
+		"$TL00,2,I,0,10,1,4,x,\n" +
+		"text\n" +
+		"<unknown token mi=0 ml=99 args=[]>\n"
+
+	var (
+		lines []int
+		errs  []error
+	)
+	p := Pipeline{
+		Translator: NewTranslator(pipelineModules),
+		Workers:    2,
+		ChunkLines: 1,
+		OnError: func(line int, err error) {
+			lines = append(lines, line)
+			errs = append(errs, err)
+		},
+	}
+
+	var out bytes.Buffer
+	if err := p.Decode(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != exp {
+		t.Errorf("expected %q but got %q", exp, out.String())
+	}
+
+	if len(errs) != 3 || lines[0] != 2 || lines[1] != 3 || lines[2] != 5 {
+		t.Fatalf("unexpected errors on lines %v: %v", lines, errs)
+	}
+	if terr, ok := errs[0].(*TranslateError); !ok || terr.Kind != TranslateUnknownModule {
+		t.Errorf("expected unknown module error but got %v", errs[0])
+	}
+	if serr, ok := errs[1].(*SyntaxError); !ok || serr.Offset != 55 {
+		t.Errorf("expected syntax error at offset 55 but got %v", errs[1])
+	}
+	if terr, ok := errs[2].(*TranslateError); !ok || terr.Kind != TranslateUnknownLine {
+		t.Errorf("expected unknown line error but got %v", errs[2])
+	}
+}
+
+func TestPipelineStrictTranslate(t *testing.T) {
+	input := "$TL00,0,I,0,10,1,4,x,\n" +
+		"$TL00,1,I,0,10,1,4,1,\n" +
+		"$TL00,2,I,0,99,0,\n" +
+		"text\n"
+
+	var errs []error
+	p := Pipeline{
+		Translator:      NewTranslator(pipelineModules),
+		Workers:         2,
+		ChunkLines:      4,
+		OnError:         func(line int, err error) { errs = append(errs, err) },
+		StrictTranslate: true,
+	}
+
+	var out bytes.Buffer
+	err := p.Decode(strings.NewReader(input), &out)
+	if lerr, ok := err.(*LineError); !ok || lerr.Line != 3 {
+		t.Errorf("expected line 3 error but got %v", err)
+	} else if terr, ok := lerr.Err.(*TranslateError); !ok || terr.Kind != TranslateUnknownLine {
+		t.Errorf("expected unknown line error but got %v", lerr.Err)
+	}
+	if exp := "$TL00,0,I,0,10,1,4,x,\ncount=1\n"; out.String() != exp {
+		t.Errorf("expected %q but got %q", exp, out.String())
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected one error but got %v", errs)
+	}
+	if _, ok := errs[0].(*SyntaxError); !ok {
+		t.Errorf("expected syntax error but got %v", errs[0])
+	}
+}
+
+func TestPipelineNoise(t *testing.T) {
+	input := "\xff\xfe\x00\n" +
+		"$TL00,0,I,0,10,1,4,1,\n" +
+		"text \x80\n" +
+		strings.Repeat("a", 100) + "\n"
+	exp := "count=1\n" +
+		"text \n" +
+		strings.Repeat("a", 32) + "\n"
+
+	p := Pipeline{
+		Translator:  NewTranslator(pipelineModules),
+		MaxLineSize: 32,
+	}
+	var out bytes.Buffer
+	if err := p.Decode(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != exp {
+		t.Errorf("expected %q but got %q", exp, out.String())
+	}
+	if p.Discarded != 72 {
+		t.Errorf("expected 72 bytes discarded but got %d", p.Discarded)
+	}
+}
+
+func TestPipelineEmbedded(t *testing.T) {
+	input := "boot: $TL00,0,I,0,10,1,4,1, ok\n" +
+		"cost: $5\n" +
+		"sdk: $TL00,1,I,0,20,1,3,^\x00multi\nline$\x00,\n" +
+		"x $TL00,2,I,0,99,0, y\n"
+	exp := "boot: count=1 ok\n" +
+		"cost: $5\n" +
+		"sdk: name=multi\nline\n" +
+		"x <unknown token mi=0 ml=99 args=[]> y\n"
+
+	p := Pipeline{
+		Translator: NewTranslator(pipelineModules),
+		OnError:    func(line int, err error) {},
+	}
+	var out bytes.Buffer
+	if err := p.Decode(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != exp {
+		t.Errorf("expected %q but got %q", exp, out.String())
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Fingerprint returns a build fingerprint for the given modules. It depends
+// only on the names, indices and lines of each module, not on where or when
+// the dictionary was built, so two dictionaries that decode output the same
+// way have the same fingerprint.
+func Fingerprint(modules []Module) string {
+	type line struct {
+		Number       int    `json:"n"`
+		Start        int    `json:"s,omitempty"`
+		Level        Level  `json:"l,omitempty"`
+		FormatString string `json:"f"`
+	}
+	type module struct {
+		Index int    `json:"i"`
+		Name  string `json:"n"`
+		Lines []line `json:"l"`
+	}
+
+	ms := make([]module, len(modules))
+	for i, m := range modules {
+		ms[i] = module{
+			Index: m.Index,
+			Name:  m.Name,
+			Lines: make([]line, len(m.Lines)),
+		}
+		for j, l := range m.Lines {
+			ms[i].Lines[j] = line(l)
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Index < ms[j].Index })
+
+	data, _ := json.Marshal(ms)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Fingerprint returns the build fingerprint of the dictionary. For a merged
+// dictionary it covers the fingerprint of every component, and it also covers
+// the line convention unless it's the default, LineEnd, which an empty line
+// convention is the same as.
+func (d *Dictionary) Fingerprint() string {
+	conv := d.LineConvention.orDefault()
+	if len(d.Components) == 0 && conv == LineEnd {
+		return Fingerprint(d.Modules)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", Fingerprint(d.Modules))
+	fmt.Fprintf(h, "%s\n", conv)
+	for _, c := range d.Components {
+		fmt.Fprintf(h, "%d:%s\n", c.ID, Fingerprint(c.Modules))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// BuildIDPrefix is the prefix of the line output by ctlog_printBuildId, which
+// identifies the dictionary a device was built with.
+const BuildIDPrefix = "ctlog-build-id: "
+
+var buildIDRegexp = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// ParseBuildID returns the build ID in a line output by ctlog_printBuildId.
+func ParseBuildID(line []byte) (id string, ok bool) {
+	if !bytes.HasPrefix(line, []byte(BuildIDPrefix)) {
+		return
+	}
+	id = string(bytes.TrimSpace(line[len(BuildIDPrefix):]))
+	ok = buildIDRegexp.MatchString(id)
+	return
+}
+
+// ErrNotInStore is returned when a dictionary can't be found in a Store.
+var ErrNotInStore = errors.New("dictionary not found in store")
+
+// A Store is a directory holding every dictionary ever published, so that
+// output from devices running any past release can be decoded. Dictionaries
+// are indexed by build fingerprint and by version tag.
+type Store struct {
+	dir string
+}
+
+type storeTags map[string]string
+
+// OpenStore opens the store in dir, creating it if it doesn't exist.
+func OpenStore(dir string) (s *Store, err error) {
+	if err = os.MkdirAll(filepath.Join(dir, "dictionaries"), 0775); err != nil {
+		return
+	}
+	s = &Store{dir: dir}
+	return
+}
+
+func (s *Store) dictPath(id string) string {
+	return filepath.Join(s.dir, "dictionaries", id+".json")
+}
+
+func (s *Store) tagsPath() string {
+	return filepath.Join(s.dir, "tags.json")
+}
+
+// Publish adds a dictionary to the store and tags it with the given version
+// tags, returning its build ID. A tag that already refers to a different
+// dictionary is an error.
+func (s *Store) Publish(dict *Dictionary, tags ...string) (id string, err error) {
+	id = dict.Fingerprint()
+	if dict.BuildID != "" && dict.BuildID != id {
+		err = fmt.Errorf("dictionary build ID %s doesn't match its fingerprint %s", dict.BuildID, id)
+		return
+	}
+
+	var allTags storeTags
+	allTags, err = s.readTags()
+	if err != nil {
+		return
+	}
+	for _, tag := range tags {
+		if other, ok := allTags[tag]; ok && other != id {
+			err = fmt.Errorf("tag '%s' already refers to build %s", tag, other)
+			return
+		}
+		allTags[tag] = id
+	}
+
+	if _, err = os.Stat(s.dictPath(id)); os.IsNotExist(err) {
+		d := *dict
+		d.BuildID = id
+
+		var data []byte
+		data, err = json.MarshalIndent(&d, "", "  ")
+		if err != nil {
+			return
+		}
+		if err = writeFileAtomic(s.dictPath(id), append(data, '\n')); err != nil {
+			return
+		}
+	} else if err != nil {
+		return
+	}
+
+	if len(tags) > 0 {
+		var data []byte
+		data, err = json.MarshalIndent(allTags, "", "  ")
+		if err != nil {
+			return
+		}
+		err = writeFileAtomic(s.tagsPath(), append(data, '\n'))
+	}
+	return
+}
+
+// Lookup returns the dictionary with the given build ID or version tag.
+func (s *Store) Lookup(key string) (dict *Dictionary, err error) {
+	id := key
+	if !buildIDRegexp.MatchString(key) {
+		var tags storeTags
+		tags, err = s.readTags()
+		if err != nil {
+			return
+		}
+		var ok bool
+		if id, ok = tags[key]; !ok {
+			err = ErrNotInStore
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(s.dictPath(id))
+	if os.IsNotExist(err) {
+		err = ErrNotInStore
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	dict = new(Dictionary)
+	if err = json.Unmarshal(data, dict); err != nil {
+		err = fmt.Errorf("error decoding dictionary %s: %v", id, err)
+	}
+	return
+}
+
+// Tags returns the build ID of each version tag in the store.
+func (s *Store) Tags() (tags map[string]string, err error) {
+	return s.readTags()
+}
+
+func (s *Store) readTags() (tags storeTags, err error) {
+	tags = make(storeTags)
+
+	data, err := ioutil.ReadFile(s.tagsPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &tags); err != nil {
+		err = fmt.Errorf("error decoding store tags: %v", err)
+	}
+	return
+}
+
+// writeFileAtomic writes data to a temporary file that is then renamed to
+// path, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) (err error) {
+	var f *os.File
+	f, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	a := []Module{
+		{Index: 0, Name: "main", Path: "/build/agent-1/main.c", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "hello"}}},
+	}
+	b := []Module{
+		{Index: 0, Name: "main", Path: "/build/agent-2/main.c", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "hello"}}},
+	}
+	c := []Module{
+		{Index: 0, Name: "main", Path: "/build/agent-1/main.c", Lines: []Line{{Number: 11, Level: LevelInfo, FormatString: "hello"}}},
+	}
+
+	if Fingerprint(a) != Fingerprint(b) {
+		t.Error("expected fingerprints to be independent of paths")
+	}
+	if Fingerprint(a) == Fingerprint(c) {
+		t.Error("expected fingerprints to depend on line numbers")
+	}
+
+	var (
+		unset = Dictionary{Modules: a}
+		end   = Dictionary{LineConvention: LineEnd, Modules: a}
+		start = Dictionary{LineConvention: LineStart, Modules: a}
+	)
+	if unset.Fingerprint() != Fingerprint(a) || end.Fingerprint() != unset.Fingerprint() {
+		t.Error("expected the default line convention not to change the fingerprint")
+	}
+	if start.Fingerprint() == unset.Fingerprint() {
+		t.Error("expected fingerprints to depend on the line convention")
+	}
+
+	id, ok := ParseBuildID([]byte(BuildIDPrefix + Fingerprint(a) + "\r"))
+	if !ok || id != Fingerprint(a) {
+		t.Errorf("failed to parse build ID, got %q", id)
+	}
+	if _, ok := ParseBuildID([]byte("build-id: " + Fingerprint(a))); ok {
+		t.Error("expected missing prefix to fail")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := Dictionary{
+		Date:    time.Date(2018, 6, 28, 0, 0, 0, 0, time.UTC),
+		Modules: []Module{{Index: 0, Name: "main", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "v1"}}}},
+	}
+	v2 := Dictionary{
+		Date:    time.Date(2018, 7, 28, 0, 0, 0, 0, time.UTC),
+		Modules: []Module{{Index: 0, Name: "main", Lines: []Line{{Number: 10, Level: LevelInfo, FormatString: "v2"}}}},
+	}
+
+	id1, err := s.Publish(&v1, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := s.Publish(&v2, "v2.0.0", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Publish(&v1, "latest"); err == nil {
+		t.Error("expected error re-using a tag")
+	}
+	if _, err := s.Publish(&v1, "v1.0.0"); err != nil {
+		t.Errorf("unexpected error re-publishing: %v", err)
+	}
+
+	for key, exp := range map[string]Dictionary{
+		id1:      v1,
+		"v1.0.0": v1,
+		id2:      v2,
+		"latest": v2,
+	} {
+		dict, err := s.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp.BuildID = Fingerprint(exp.Modules)
+		if !reflect.DeepEqual(*dict, exp) {
+			t.Errorf("%s: expected %+v but got %+v", key, exp, *dict)
+		}
+	}
+
+	if _, err := s.Lookup("v3.0.0"); err != ErrNotInStore {
+		t.Errorf("expected ErrNotInStore but got %v", err)
+	}
+	if _, err := s.Lookup("0123456789abcdef"); err != ErrNotInStore {
+		t.Errorf("expected ErrNotInStore but got %v", err)
+	}
+
+	tags, err := s.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := map[string]string{"v1.0.0": id1, "v2.0.0": id2, "latest": id2}; !reflect.DeepEqual(tags, exp) {
+		t.Errorf("expected tags %v but got %v", exp, tags)
+	}
+}
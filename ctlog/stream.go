@@ -0,0 +1,512 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Stream is an independent stream of output from a Source, e.g. one
+// connection.
+type Stream interface {
+	io.ReadCloser
+
+	// Name identifies the stream, e.g. the address of the remote end.
+	Name() string
+}
+
+// A Source provides streams of output to be decoded independently, e.g. the
+// connections to a listener.
+type Source interface {
+	// Next blocks until the next stream is available and returns it. Once
+	// the source is closed it returns io.EOF.
+	Next() (Stream, error)
+
+	// Close stops the source, closing any streams it still has open.
+	Close() error
+}
+
+// ParseAddress splits an address like "tcp://:4000", "udp://bridge:2000" or
+// "unix:///tmp/uart.sock" into its network and address.
+func ParseAddress(s string) (network, addr string, err error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		err = fmt.Errorf("address '%s' must be like tcp://host:port", s)
+		return
+	}
+	network, addr = s[:i], s[i+3:]
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix":
+	default:
+		err = fmt.Errorf("unsupported network '%s' in address '%s'", network, s)
+	}
+	return
+}
+
+// Listen returns a source that listens on the given address, see
+// ParseAddress. For TCP and Unix sockets each connection is a stream, for
+// UDP the datagrams from each remote address are a stream.
+func Listen(address string) (src Source, err error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(network, "udp") {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket(network, addr); err != nil {
+			return
+		}
+		src = newPacketSource(conn)
+		return
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return
+	}
+	src = &listenerSource{
+		l:     l,
+		conns: make(map[net.Conn]bool),
+	}
+	return
+}
+
+// Addr returns the local address a source returned by Listen is listening
+// on, or nil for any other source.
+func Addr(src Source) net.Addr {
+	switch s := src.(type) {
+	case *listenerSource:
+		return s.l.Addr()
+	case *packetSource:
+		return s.conn.LocalAddr()
+	}
+	return nil
+}
+
+type connStream struct {
+	net.Conn
+	name string
+}
+
+func (s *connStream) Name() string {
+	return s.name
+}
+
+type listenerSource struct {
+	l net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	n      int // number of connections accepted
+	closed bool
+}
+
+func (s *listenerSource) Next() (stream Stream, err error) {
+	conn, err := s.l.Accept()
+	if err != nil {
+		s.mu.Lock()
+		if s.closed {
+			err = io.EOF
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.n++
+	n := s.n
+	s.mu.Unlock()
+
+	var name string
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		name = addr.String()
+	} else {
+		// Unix socket clients usually aren't bound to an address so number
+		// them instead
+		name = fmt.Sprintf("%s#%d", conn.LocalAddr(), n)
+	}
+	stream = &listenerStream{
+		connStream: connStream{conn, name},
+		src:        s,
+	}
+	return
+}
+
+func (s *listenerSource) Close() (err error) {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return s.l.Close()
+}
+
+type listenerStream struct {
+	connStream
+	src *listenerSource
+}
+
+func (s *listenerStream) Close() error {
+	s.src.mu.Lock()
+	delete(s.src.conns, s.Conn)
+	s.src.mu.Unlock()
+	return s.Conn.Close()
+}
+
+// maxDatagramSize is the size of the largest UDP datagram.
+const maxDatagramSize = 65535
+
+// packetSource demultiplexes the datagrams received by conn into a stream
+// for each remote address.
+type packetSource struct {
+	conn net.PacketConn
+
+	streams chan Stream
+	err     error // read error, valid once streams is closed
+
+	mu     sync.Mutex
+	peers  map[string]*packetStream
+	closed bool
+}
+
+func newPacketSource(conn net.PacketConn) *packetSource {
+	s := &packetSource{
+		conn:    conn,
+		streams: make(chan Stream),
+		peers:   make(map[string]*packetStream),
+	}
+	go s.receive()
+	return s
+}
+
+func (s *packetSource) receive() {
+	defer close(s.streams)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			if !s.closed {
+				s.err = err
+			}
+			for _, ps := range s.peers {
+				ps.closeWrite()
+			}
+			s.mu.Unlock()
+			return
+		}
+
+		name := addr.String()
+		s.mu.Lock()
+		ps, ok := s.peers[name]
+		if !ok {
+			ps = newPacketStream(name)
+			ps.onClose = func() {
+				s.mu.Lock()
+				delete(s.peers, name)
+				s.mu.Unlock()
+			}
+			s.peers[name] = ps
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			s.streams <- ps
+		}
+		ps.write(append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (s *packetSource) Next() (stream Stream, err error) {
+	stream, ok := <-s.streams
+	if !ok {
+		err = s.err
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	return
+}
+
+func (s *packetSource) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	peers := make([]*packetStream, 0, len(s.peers))
+	for _, ps := range s.peers {
+		peers = append(peers, ps)
+	}
+	s.mu.Unlock()
+	err := s.conn.Close()
+	for _, ps := range peers {
+		ps.Close()
+	}
+
+	// Drain any stream waiting to be returned by Next so receive finishes
+	for range s.streams {
+	}
+	return err
+}
+
+// packetStream is a stream of the datagrams from one remote address.
+type packetStream struct {
+	name    string
+	packets chan []byte
+	done    chan struct{}
+	buf     []byte
+	onClose func()
+
+	closeOnce sync.Once
+	writeOnce sync.Once
+}
+
+func newPacketStream(name string) *packetStream {
+	return &packetStream{
+		name:    name,
+		packets: make(chan []byte, 256),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *packetStream) Name() string {
+	return s.name
+}
+
+// write queues a datagram to be read, blocking while the queue is full.
+func (s *packetStream) write(p []byte) {
+	select {
+	case s.packets <- p:
+	case <-s.done:
+	}
+}
+
+// closeWrite makes Read return io.EOF once the queued datagrams are read.
+func (s *packetStream) closeWrite() {
+	s.writeOnce.Do(func() { close(s.packets) })
+}
+
+func (s *packetStream) Read(p []byte) (n int, err error) {
+	for len(s.buf) == 0 {
+		var ok bool
+		select {
+		case s.buf, ok = <-s.packets:
+			if !ok {
+				return 0, io.EOF
+			}
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n = copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return
+}
+
+func (s *packetStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return nil
+}
+
+// DefaultRetryInterval is the default time between attempts to reconnect
+// by a source returned by Connect.
+const DefaultRetryInterval = time.Second
+
+// Connect returns a source that connects to the given address, see
+// ParseAddress. Its first stream is the connection made by Connect. Once a
+// stream is closed the next call to Next reconnects, trying every
+// retryInterval, or DefaultRetryInterval if zero, until it succeeds or the
+// source is closed. For UDP an empty datagram is sent when connecting so the
+// remote end knows where to send its output.
+func Connect(address string, retryInterval time.Duration) (src Source, err error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return
+	}
+	if retryInterval <= 0 {
+		retryInterval = DefaultRetryInterval
+	}
+
+	ds := &dialSource{
+		network:       network,
+		addr:          addr,
+		retryInterval: retryInterval,
+		done:          make(chan struct{}),
+	}
+	if ds.conn, err = ds.dial(); err != nil {
+		return
+	}
+	src = ds
+	return
+}
+
+type dialSource struct {
+	network       string
+	addr          string
+	retryInterval time.Duration
+
+	mu        sync.Mutex
+	conn      net.Conn      // current connection
+	closed    chan struct{} // closed with the current connection's stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *dialSource) dial() (conn net.Conn, err error) {
+	if conn, err = net.Dial(s.network, s.addr); err != nil {
+		return
+	}
+	if strings.HasPrefix(s.network, "udp") {
+		if _, err = conn.Write(nil); err != nil {
+			conn.Close()
+		}
+	}
+	return
+}
+
+func (s *dialSource) Next() (stream Stream, err error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+
+	if closed != nil {
+		// Wait for the current stream to end before reconnecting
+		select {
+		case <-closed:
+		case <-s.done:
+			err = io.EOF
+			return
+		}
+
+		for {
+			select {
+			case <-time.After(s.retryInterval):
+			case <-s.done:
+				err = io.EOF
+				return
+			}
+			if conn, derr := s.dial(); derr == nil {
+				s.mu.Lock()
+				s.conn = conn
+				s.mu.Unlock()
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		s.conn.Close()
+		err = io.EOF
+		return
+	default:
+	}
+
+	s.closed = make(chan struct{})
+	ds := &dialStream{
+		connStream: connStream{s.conn, s.addr},
+		closed:     s.closed,
+	}
+	if strings.HasPrefix(s.network, "udp") {
+		stream = &datagramStream{dialStream: ds}
+	} else {
+		stream = ds
+	}
+	return
+}
+
+func (s *dialSource) Close() (err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		err = s.conn.Close()
+		s.mu.Unlock()
+	})
+	return
+}
+
+type dialStream struct {
+	connStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *dialStream) Close() (err error) {
+	err = s.Conn.Close()
+	s.closeOnce.Do(func() { close(s.closed) })
+	return
+}
+
+// datagramStream reads whole datagrams from a connection even if they're
+// larger than the buffer passed to Read, which would otherwise truncate
+// them.
+type datagramStream struct {
+	*dialStream
+	buf     []byte
+	pending []byte
+}
+
+func (s *datagramStream) Read(p []byte) (n int, err error) {
+	if len(s.pending) == 0 {
+		if s.buf == nil {
+			s.buf = make([]byte, maxDatagramSize)
+		}
+		if n, err = s.Conn.Read(s.buf); err != nil {
+			return
+		}
+		s.pending = s.buf[:n]
+	}
+	n = copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return
+}
+
+// A SequenceTracker detects output lines that were dropped from a stream
+// using their sequence numbers. Each component's sequence numbers are
+// tracked separately, and a repeated sequence number is ignored. The zero
+// value is ready to use.
+type SequenceTracker struct {
+	last map[uint32]uint16
+}
+
+// maxWrapGap is the most lines counted as dropped when a sequence number
+// wraps around from 65535 to 0, a larger gap is assumed to be a reset.
+const maxWrapGap = 256
+
+// Track records the sequence number of the next line of output and returns
+// how many lines were dropped before it. A sequence number lower than the
+// last one is either a wraparound, if few lines were dropped, or else a reset
+// of the device, in which case only the lines since the reset are counted.
+func (t *SequenceTracker) Track(output *Output) (dropped int) {
+	if t.last == nil {
+		t.last = make(map[uint32]uint16)
+	}
+	last, ok := t.last[output.Component]
+	t.last[output.Component] = output.Sequence
+	if !ok || output.Sequence == last {
+		return
+	}
+
+	// Sequence numbers wrap around
+	dropped = int(output.Sequence - last - 1)
+	if output.Sequence < last && dropped >= maxWrapGap {
+		dropped = int(output.Sequence)
+	}
+	return
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseAddress(t *testing.T) {
+	var cases = []struct {
+		Address string
+		Network string
+		Addr    string
+		Err     bool
+	}{
+		{Address: "tcp://:4000", Network: "tcp", Addr: ":4000"},
+		{Address: "udp://bridge:2000", Network: "udp", Addr: "bridge:2000"},
+		{Address: "unix:///tmp/uart.sock", Network: "unix", Addr: "/tmp/uart.sock"},
+		{Address: "bridge:2000", Err: true},
+		{Address: "http://bridge", Err: true},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		network, addr, err := ParseAddress(tc.Address)
+		if tc.Err {
+			if err == nil {
+				t.Error("expected error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if network != tc.Network || addr != tc.Addr {
+			t.Errorf("expected %s %s but got %s %s", tc.Network, tc.Addr, network, addr)
+		}
+	}
+}
+
+func TestSequenceTracker(t *testing.T) {
+	var cases = []struct {
+		Component uint32
+		Sequence  uint16
+		Dropped   int
+	}{
+		{Sequence: 5, Dropped: 0},
+		{Sequence: 6, Dropped: 0},
+		{Sequence: 9, Dropped: 2},
+		{Component: 2, Sequence: 100, Dropped: 0},
+		{Sequence: 10, Dropped: 0},
+		{Sequence: 10, Dropped: 0},
+		{Sequence: 0, Dropped: 0},
+		{Sequence: 65535, Dropped: 65534},
+		{Sequence: 1, Dropped: 1},
+		{Component: 2, Sequence: 102, Dropped: 1},
+
+		// Wraparounds
+		{Sequence: 65535, Dropped: 65533},
+		{Sequence: 0, Dropped: 0},
+		{Sequence: 65530, Dropped: 65529},
+		{Sequence: 0, Dropped: 5},
+		{Sequence: 65534, Dropped: 65533},
+		{Sequence: 2, Dropped: 3},
+
+		// Resets, the first one without sequence number 0
+		{Sequence: 1000, Dropped: 997},
+		{Sequence: 3, Dropped: 3},
+		{Sequence: 0, Dropped: 0},
+		{Sequence: 40000, Dropped: 39999},
+		{Sequence: 0, Dropped: 0},
+	}
+
+	var tracker SequenceTracker
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		output := Output{Component: tc.Component, Sequence: tc.Sequence}
+		if dropped := tracker.Track(&output); dropped != tc.Dropped {
+			t.Errorf("expected %d dropped but got %d", tc.Dropped, dropped)
+		}
+	}
+}
+
+// readStream reads the next stream from src and all of its output.
+func readStream(t *testing.T, src Source) (name, data string) {
+	stream, err := src.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer stream.Close()
+
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return stream.Name(), string(b)
+}
+
+func TestListenTCP(t *testing.T) {
+	src, err := Listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var locals []string
+	for _, data := range []string{"first\n", "second\n"} {
+		conn, err := net.Dial("tcp", Addr(src).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(data))
+		locals = append(locals, conn.LocalAddr().String())
+		conn.Close()
+	}
+
+	for i, exp := range []string{"first\n", "second\n"} {
+		t.Logf("Test case %d", i)
+
+		name, data := readStream(t, src)
+		if name != locals[i] {
+			t.Errorf("expected stream name %s but got %s", locals[i], name)
+		}
+		if data != exp {
+			t.Errorf("expected %q but got %q", exp, data)
+		}
+	}
+
+	src.Close()
+	if _, err := src.Next(); err != io.EOF {
+		t.Errorf("expected EOF after closing but got %v", err)
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	src, err := Listen("udp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", Addr(src).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	conns[0].Write([]byte("a1\n"))
+	streams := make(map[string]Stream)
+	for i := 0; i < 2; i++ {
+		stream, err := src.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[stream.Name()] = stream
+		if i == 0 {
+			conns[1].Write([]byte("b1\n"))
+			conns[0].Write([]byte("a2\n"))
+		}
+	}
+
+	var cases = []struct {
+		Conn net.Conn
+		Exp  string
+	}{
+		{Conn: conns[0], Exp: "a1\na2\n"},
+		{Conn: conns[1], Exp: "b1\n"},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		stream, ok := streams[tc.Conn.LocalAddr().String()]
+		if !ok {
+			t.Fatalf("expected a stream from %s", tc.Conn.LocalAddr())
+		}
+		buf := make([]byte, len(tc.Exp))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != tc.Exp {
+			t.Errorf("expected %q but got %q", tc.Exp, buf)
+		}
+	}
+
+	// Closing the source ends its streams
+	src.Close()
+	for name, stream := range streams {
+		if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected EOF from %s but got %v", name, err)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for _, data := range []string{"first\n", "second\n"} {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(data))
+			conn.Close()
+		}
+	}()
+
+	src, err := Connect("tcp://"+l.Addr().String(), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for i, exp := range []string{"first\n", "second\n"} {
+		t.Logf("Test case %d", i)
+
+		name, data := readStream(t, src)
+		if name != l.Addr().String() {
+			t.Errorf("expected stream name %s but got %s", l.Addr(), name)
+		}
+		if data != exp {
+			t.Errorf("expected %q but got %q", exp, data)
+		}
+	}
+
+	if _, err := Connect("tcp://127.0.0.1:1", 0); err == nil {
+		t.Error("expected error connecting to a closed port")
+	}
+}
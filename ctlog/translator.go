@@ -0,0 +1,347 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Translator translates tokenized logging output into log lines using the
+// format strings in a dictionary. The lines of every module are indexed when
+// the translator is created, so a Translator is safe for concurrent use.
+type Translator struct {
+	components map[uint32]*lineIndex
+
+	// lineConvention is tried first when looking up multi-line invocations,
+	// falling back to the other line if it isn't found.
+	lineConvention LineConvention
+}
+
+// NewTranslator returns a translator for output without a component ID.
+func NewTranslator(modules []Module) *Translator {
+	return &Translator{
+		components: map[uint32]*lineIndex{
+			0: newLineIndex(modules),
+		},
+	}
+}
+
+// NewDictionaryTranslator returns a translator for the dictionary's modules
+// and those of each of its components.
+func NewDictionaryTranslator(dict *Dictionary) *Translator {
+	t := NewTranslator(dict.Modules)
+	t.lineConvention = dict.LineConvention
+	for _, c := range dict.Components {
+		t.components[c.ID] = newLineIndex(c.Modules)
+	}
+	return t
+}
+
+func (t *Translator) Translate(output *Output) (s string, err error) {
+	// Find the component's modules
+	index, ok := t.components[output.Component]
+	if !ok {
+		err = newTranslateError(TranslateUnknownComponent, output)
+		return
+	}
+
+	// Find module first
+	if output.ModuleIndex >= uint32(index.nModules) {
+		err = newTranslateError(TranslateUnknownModule, output)
+		return
+	}
+
+	// Find the line within the module using the compiler's line convention
+	// first, then the other line in case the convention is wrong
+	key := lineKey{Module: output.ModuleIndex, Number: uint32(output.LineNumber)}
+	byLine := [2]map[lineKey]*indexedLine{index.byEnd, index.byStart}
+	if t.lineConvention == LineStart {
+		byLine[0], byLine[1] = byLine[1], byLine[0]
+	}
+	for _, m := range byLine {
+		if line, ok := m[key]; ok {
+			if line.ambiguous {
+				err = newTranslateError(TranslateAmbiguousLine, output)
+				return
+			}
+			s = line.format(output)
+			return
+		}
+	}
+
+	err = newTranslateError(TranslateUnknownLine, output)
+	return
+}
+
+// A TranslateErrorKind is the reason output couldn't be translated.
+type TranslateErrorKind int
+
+const (
+	// TranslateUnknownComponent is output with a component ID that isn't in
+	// the dictionary. Output without one uses the dictionary's modules.
+	TranslateUnknownComponent TranslateErrorKind = iota
+
+	// TranslateUnknownModule is output whose module index isn't in the
+	// dictionary.
+	TranslateUnknownModule
+
+	// TranslateUnknownLine is output whose line number isn't in its module.
+	TranslateUnknownLine
+
+	// TranslateAmbiguousLine is output whose line number is shared by
+	// logging calls that decode differently, see Dictionary.Collisions.
+	TranslateAmbiguousLine
+)
+
+func (k TranslateErrorKind) String() string {
+	switch k {
+	case TranslateUnknownComponent:
+		return "unknown component"
+	case TranslateUnknownModule:
+		return "unknown module"
+	case TranslateUnknownLine:
+		return "unknown line"
+	case TranslateAmbiguousLine:
+		return "ambiguous line"
+	default:
+		return fmt.Sprintf("TranslateErrorKind(%d)", int(k))
+	}
+}
+
+// A TranslateError is returned when output can't be translated, usually
+// because it's from a different build than the dictionary.
+type TranslateError struct {
+	Kind        TranslateErrorKind
+	Component   uint32
+	ModuleIndex uint32
+	LineNumber  uint32
+}
+
+func newTranslateError(kind TranslateErrorKind, output *Output) *TranslateError {
+	return &TranslateError{
+		Kind:        kind,
+		Component:   output.Component,
+		ModuleIndex: output.ModuleIndex,
+		LineNumber:  output.LineNumber,
+	}
+}
+
+func (e *TranslateError) Error() string {
+	switch e.Kind {
+	case TranslateUnknownComponent:
+		return fmt.Sprintf("could not find component %d", e.Component)
+	case TranslateUnknownModule:
+		return fmt.Sprintf("could not find module %d", e.ModuleIndex)
+	case TranslateAmbiguousLine:
+		return fmt.Sprintf("line %d in module %d is ambiguous", e.LineNumber, e.ModuleIndex)
+	default:
+		return fmt.Sprintf("could not find line %d in module %d", e.LineNumber, e.ModuleIndex)
+	}
+}
+
+// FormatUnknown formats output that couldn't be translated so that its
+// values aren't lost, e.g. "<unknown token mi=7 ml=88 args=[5 "idle"]>".
+func FormatUnknown(output *Output) string {
+	var b bytes.Buffer
+	b.WriteString("<unknown token ")
+	if output.Component != 0 {
+		fmt.Fprintf(&b, "cid=%d ", output.Component)
+	}
+	fmt.Fprintf(&b, "mi=%d ml=%d args=[", output.ModuleIndex, output.LineNumber)
+	for i, arg := range output.Args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		switch v := arg.Value.(type) {
+		case byte:
+			b.WriteString(strconv.QuoteRune(rune(v)))
+		case string:
+			b.WriteString(strconv.Quote(v))
+		default:
+			fmt.Fprint(&b, v)
+		}
+	}
+	b.WriteString("]>")
+	return b.String()
+}
+
+type lineKey struct {
+	Module uint32
+	Number uint32
+}
+
+// A lineIndex indexes the lines of a component's modules by both their end
+// and start line numbers.
+type lineIndex struct {
+	nModules int
+	byEnd    map[lineKey]*indexedLine
+	byStart  map[lineKey]*indexedLine
+}
+
+type indexedLine struct {
+	formatString string
+
+	// hasVerbs is false if the format string can be output as is.
+	hasVerbs bool
+
+	// segments is the format string parsed into literals and verbs, or nil
+	// if it uses argument indexes or a '*' width or precision, which are left
+	// to fmt.Sprintf.
+	segments []formatSegment
+
+	// ambiguous is true if more than one line with the same number decodes
+	// differently. Dictionaries built before collisions were detected may
+	// have these.
+	ambiguous bool
+}
+
+func newLineIndex(modules []Module) *lineIndex {
+	index := &lineIndex{
+		nModules: len(modules),
+		byEnd:    make(map[lineKey]*indexedLine),
+		byStart:  make(map[lineKey]*indexedLine),
+	}
+
+	// Lines with the same format string share an indexedLine, so they're
+	// only ambiguous if they decode differently
+	formats := make(map[string]*indexedLine)
+
+	for mi, module := range modules {
+		for _, line := range module.Lines {
+			l, ok := formats[line.FormatString]
+			if !ok {
+				l = &indexedLine{
+					formatString: line.FormatString,
+					hasVerbs:     strings.IndexByte(line.FormatString, '%') != -1,
+				}
+				if l.hasVerbs {
+					l.segments = parseFormat(line.FormatString)
+				}
+				formats[line.FormatString] = l
+			}
+
+			start := line.Start
+			if start == 0 {
+				start = line.Number
+			}
+			index.add(index.byEnd, lineKey{uint32(mi), uint32(line.Number)}, l)
+			index.add(index.byStart, lineKey{uint32(mi), uint32(start)}, l)
+		}
+	}
+	return index
+}
+
+func (index *lineIndex) add(m map[lineKey]*indexedLine, key lineKey, l *indexedLine) {
+	other, ok := m[key]
+	if !ok {
+		m[key] = l
+	} else if other != l {
+		m[key] = &indexedLine{ambiguous: true}
+	}
+}
+
+func (l *indexedLine) format(output *Output) string {
+	if !l.hasVerbs && len(output.Args) == 0 {
+		return l.formatString
+	}
+	if l.segments == nil {
+		// Either there are extra arguments without any verbs, or the verbs
+		// are left to fmt.Sprintf
+		return fmt.Sprintf(l.formatString, output.Vals()...)
+	}
+
+	b := make([]byte, 0, len(l.formatString)+16)
+	n := 0
+	for _, seg := range l.segments {
+		b = append(b, seg.literal...)
+		if seg.verb == "" {
+			continue
+		}
+		if n < len(output.Args) {
+			b = appendVerb(b, seg.verb, output.Args[n].Value)
+			n++
+		} else {
+			b = append(b, fmt.Sprintf(seg.verb)...)
+		}
+	}
+	if n < len(output.Args) {
+		// Same as fmt.Sprintf, e.g. "%!(EXTRA uint32=5)"
+		b = append(b, "%!(EXTRA "...)
+		for i, arg := range output.Args[n:] {
+			if i > 0 {
+				b = append(b, ", "...)
+			}
+			b = append(b, fmt.Sprintf("%T=%v", arg.Value, arg.Value)...)
+		}
+		b = append(b, ')')
+	}
+	return string(b)
+}
+
+// A formatSegment is a literal followed by a verb, which is empty for the
+// end of a format string.
+type formatSegment struct {
+	literal string
+	verb    string
+}
+
+// parseFormat splits format into literals and the verbs after them, each of
+// which uses one argument, so the format string isn't parsed each time it's
+// output. It returns nil if a verb uses an argument index or a '*' width or
+// precision, or if the format ends in the middle of a verb.
+func parseFormat(format string) (segments []formatSegment) {
+	var lit []byte
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			lit = append(lit, format[i])
+			i++
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			lit = append(lit, '%')
+			i += 2
+			continue
+		}
+
+		start := i
+		for i++; i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) != -1; i++ {
+		}
+		if i == len(format) || format[i] == '*' || format[i] == '[' {
+			return nil
+		}
+		_, size := utf8.DecodeRuneInString(format[i:])
+		i += size
+
+		segments = append(segments, formatSegment{
+			literal: string(lit),
+			verb:    format[start:i],
+		})
+		lit = lit[:0]
+	}
+	return append(segments, formatSegment{literal: string(lit)})
+}
+
+// appendVerb appends v formatted by verb to b, without going through
+// fmt.Sprintf for the common verbs.
+func appendVerb(b []byte, verb string, v interface{}) []byte {
+	switch verb {
+	case "%d":
+		switch v := v.(type) {
+		case int32:
+			return strconv.AppendInt(b, int64(v), 10)
+		case uint32:
+			return strconv.AppendUint(b, uint64(v), 10)
+		}
+	case "%s", "%v":
+		if v, ok := v.(string); ok {
+			return append(b, v...)
+		}
+	}
+	return append(b, fmt.Sprintf(verb, v)...)
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctlog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTranslatorFormat(t *testing.T) {
+	tx := NewTranslator([]Module{
+		{
+			Index: 0,
+			Name:  "main",
+			Lines: []Line{
+				{Number: 10, FormatString: "count=%d"},
+				{Number: 11, FormatString: "100%% done"},
+				{Number: 12, FormatString: "count=%d"},
+			},
+		},
+	})
+
+	var cases = []struct {
+		Output Output
+		Exp    string
+	}{
+		{
+			Output: Output{LineNumber: 10, Args: []Arg{{Type: TypeUint, Value: uint32(5)}}},
+			Exp:    "count=5",
+		},
+		{
+			Output: Output{LineNumber: 11},
+			Exp:    "100% done",
+		},
+		{
+			Output: Output{LineNumber: 12, Args: []Arg{{Type: TypeUint, Value: uint32(6)}}},
+			Exp:    "count=6",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		s, err := tx.Translate(&tc.Output)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if s != tc.Exp {
+			t.Errorf("expected %q but got %q", tc.Exp, s)
+		}
+	}
+}
+
+// TestTranslatorSegments checks that formatting from the parsed segments
+// matches fmt.Sprintf, including for missing and extra arguments.
+func TestTranslatorSegments(t *testing.T) {
+	formats := []string{
+		"",
+		"no verbs",
+		"100%% done",
+		"count=%d",
+		"%d%%",
+		"%s=%d, %-5s|%05d|%x",
+		"%c %t %v %q",
+		"%.3s|%8.2f",
+		"%*d",
+		"%[2]d %[1]d",
+		"trailing %",
+		"trailing %-",
+		"é=%d",
+	}
+	args := [][]Arg{
+		nil,
+		{{Type: TypeUint, Value: uint32(5)}},
+		{{Type: TypeString, Value: "a"}, {Type: TypeInt, Value: int32(-7)}},
+		{
+			{Type: TypeString, Value: "abcdef"},
+			{Type: TypeInt, Value: int32(42)},
+			{Type: TypeChar, Value: byte('x')},
+			{Type: TypeInt, Value: int32(255)},
+			{Type: TypeUint, Value: uint32(3)},
+			{Type: TypeBool, Value: true},
+		},
+	}
+
+	for _, format := range formats {
+		tx := NewTranslator([]Module{{Lines: []Line{{Number: 10, FormatString: format}}}})
+		for i, a := range args {
+			output := Output{LineNumber: 10, Args: a}
+			exp := fmt.Sprintf(format, output.Vals()...)
+			s, err := tx.Translate(&output)
+			if err != nil {
+				t.Errorf("%q with args %d: unexpected error: %v", format, i, err)
+			} else if s != exp {
+				t.Errorf("%q with args %d: expected %q but got %q", format, i, exp, s)
+			}
+		}
+	}
+}
+
+func BenchmarkTranslate(b *testing.B) {
+	const nModules, nLines = 50, 2000
+
+	modules := make([]Module, nModules)
+	for i := range modules {
+		modules[i] = Module{
+			Index: i,
+			Name:  fmt.Sprintf("module_%d", i),
+			Lines: make([]Line, nLines),
+		}
+		for j := range modules[i].Lines {
+			modules[i].Lines[j] = Line{
+				Number:       10 * (j + 1),
+				FormatString: fmt.Sprintf("line %d value=%%d name=%%s", j),
+			}
+		}
+	}
+	tx := NewTranslator(modules)
+
+	output := Output{
+		ModuleIndex: nModules - 1,
+		LineNumber:  10 * nLines,
+		Args: []Arg{
+			{Type: TypeUint, Value: uint32(123)},
+			{Type: TypeString, Value: "sensor"},
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tx.Translate(&output); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	var cases = []struct {
+		Output Output
+		Exp    string
+	}{
+		{
+			Output: Output{ModuleIndex: 7, LineNumber: 88},
+			Exp:    "<unknown token mi=7 ml=88 args=[]>",
+		},
+		{
+			Output: Output{
+				Component:   2,
+				ModuleIndex: 1,
+				LineNumber:  3,
+				Args: []Arg{
+					{Type: TypeBool, Value: true},
+					{Type: TypeChar, Value: byte('J')},
+					{Type: TypeInt, Value: int32(-1)},
+					{Type: TypeString, Value: "a \"b\"\n"},
+					{Type: TypeUint, Value: uint32(5)},
+				},
+			},
+			Exp: `<unknown token cid=2 mi=1 ml=3 args=[true 'J' -1 "a \"b\"\n" 5]>`,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		if s := FormatUnknown(&tc.Output); s != tc.Exp {
+			t.Errorf("expected %s but got %s", tc.Exp, s)
+		}
+	}
+}
+
+func TestTranslateError(t *testing.T) {
+	tx := NewTranslator([]Module{
+		{
+			Index: 0,
+			Name:  "main",
+			Lines: []Line{
+				{Number: 10, FormatString: "a"},
+				{Number: 10, FormatString: "b"},
+			},
+		},
+	})
+
+	var cases = []struct {
+		Output Output
+		Kind   TranslateErrorKind
+	}{
+		{Output: Output{Component: 1}, Kind: TranslateUnknownComponent},
+		{Output: Output{ModuleIndex: 1}, Kind: TranslateUnknownModule},
+		{Output: Output{LineNumber: 11}, Kind: TranslateUnknownLine},
+		{Output: Output{LineNumber: 10}, Kind: TranslateAmbiguousLine},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		_, err := tx.Translate(&tc.Output)
+		if terr, ok := err.(*TranslateError); !ok || terr.Kind != tc.Kind {
+			t.Errorf("expected %s error but got %v", tc.Kind, err)
+		}
+	}
+}
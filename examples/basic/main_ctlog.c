@@ -3,6 +3,7 @@
 #include <stdio.h>
 
 #include "ctlog.h"
+#include "ctlog_build_id.h"
 
 CMODULE_DEFINE( main );
 
@@ -12,6 +13,7 @@ int
 main( void )
 {
     ctlog_setStream( stdout );
+    CTLOG_PRINT_BUILD_ID();
     CTLOG_VAR_INFO( "%s", 1, CTLOG_TYPE_STRING( g_long_str ) );
     CTLOG_VAR_INFO( "%d", 1, CTLOG_TYPE_UINT( 123 ) );
     CTLOG_VAR_INFO( "%d", 1, CTLOG_TYPE_UINT( 456 ) );
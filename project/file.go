@@ -0,0 +1,102 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to the named file, creating any parent directories, but
+// only if the file doesn't already contain data. This keeps the modification
+// time of unchanged files intact so build tools like make don't rebuild
+// everything that depends on them. The data is written to a temporary file that
+// is then renamed over the original, so readers never observe a partially
+// written file. It returns whether the file was written.
+func WriteFile(path string, data []byte, perm os.FileMode) (written bool, err error) {
+	ws, err := WriteFiles([]File{{Path: path, Data: data, Perm: perm}})
+	if err != nil {
+		return
+	}
+	written = ws[0]
+	return
+}
+
+// A File is a file written by WriteFiles.
+type File struct {
+	Path string
+	Data []byte
+	Perm os.FileMode
+}
+
+// WriteFiles is like WriteFile for several files that must stay consistent
+// with each other, e.g. a generated header and the dictionary it belongs to.
+// Every changed file is written to a temporary file before any of them are
+// renamed over the originals, so failing to write one leaves all of them
+// unchanged. It returns whether each file was written.
+func WriteFiles(files []File) (written []bool, err error) {
+	written = make([]bool, len(files))
+	temps := make([]string, len(files))
+	defer func() {
+		for _, temp := range temps {
+			if temp != "" {
+				os.Remove(temp)
+			}
+		}
+	}()
+
+	for i, file := range files {
+		if temps[i], err = writeTemp(file); err != nil {
+			return
+		}
+	}
+	for i, file := range files {
+		if temps[i] == "" {
+			continue
+		}
+		if err = os.Rename(temps[i], file.Path); err != nil {
+			return
+		}
+		temps[i] = ""
+		written[i] = true
+	}
+	return
+}
+
+// writeTemp writes a file's data to a temporary file next to it and returns
+// its name, or an empty name if the file already contains the data.
+func writeTemp(file File) (name string, err error) {
+	old, err := ioutil.ReadFile(file.Path)
+	if err == nil && bytes.Equal(old, file.Data) {
+		return
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	dir := filepath.Dir(file.Path)
+	if err = os.MkdirAll(dir, 0775); err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(file.Path)+".tmp")
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(file.Data); err == nil {
+		if err = f.Chmod(file.Perm); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	name = f.Name()
+	return
+}
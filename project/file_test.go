@@ -0,0 +1,107 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "build", "out.txt")
+
+	var cases = []struct {
+		Data    string
+		Written bool
+	}{
+		{Data: "first", Written: true},
+		{Data: "first", Written: false},
+		{Data: "second", Written: true},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test case %d", i)
+
+		written, err := WriteFile(path, []byte(tc.Data), 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != tc.Written {
+			t.Errorf("expected written=%t but got %t", tc.Written, written)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.Data {
+			t.Errorf("expected %q but got %q", tc.Data, data)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("expected temporary files to be removed but found %d files", len(infos))
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if _, err := WriteFile(a, []byte("a"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := WriteFiles([]File{
+		{Path: a, Data: []byte("a"), Perm: 0664},
+		{Path: b, Data: []byte("b"), Perm: 0664},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written[0] || !written[1] {
+		t.Errorf("expected only b.txt to be written but got %v", written)
+	}
+
+	// A file that can't be written leaves the others unchanged
+	if err := os.Mkdir(filepath.Join(dir, "c.txt"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	_, err = WriteFiles([]File{
+		{Path: a, Data: []byte("new a"), Perm: 0664},
+		{Path: filepath.Join(dir, "c.txt"), Data: []byte("c"), Perm: 0664},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if data, _ := ioutil.ReadFile(a); string(data) != "a" {
+		t.Errorf("expected a.txt to be unchanged but got %q", data)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected temporary files to be removed but found %d files", len(infos))
+	}
+}
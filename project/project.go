@@ -0,0 +1,271 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package project loads ctlog project configuration files.
+
+A project configuration file is a JSON file named ctlog.json, usually placed at
+the root of a project. The cmodule and ctlog commands discover it by walking up
+from the working directory, so the search roots, macros and output locations
+don't need to be repeated on every command line. For example:
+
+	{
+	  "roots": ["src"],
+	  "excludes": ["third_party"],
+	  "extensions": [".c", ".cpp", ".h"],
+	  "macros": [
+	    {"name": "APP_LOG", "formatArg": 1, "countArg": 2}
+	  ],
+	  "header": {
+	    "defines": {"CTLOG_LEVELS_ENABLED": "(0x0F)"}
+	  },
+	  "output": {
+	    "modules": "build/cmodule_indices.json",
+	    "header": "build/cmodule_indices.h",
+	    "dictionary": "build/ctlog_dict.json"
+	  },
+	  "cache": "build/ctlog_cache.json"
+	}
+
+All relative paths are relative to the directory containing the file.
+*/
+package project
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jlubawy/go-ctlog/cmodule"
+	"github.com/jlubawy/go-ctlog/ctlog"
+)
+
+// FileName is the name of a project configuration file.
+const FileName = "ctlog.json"
+
+// ErrNotFound is returned by Find when no project configuration file exists in
+// the directory or any of its parents.
+var ErrNotFound = errors.New("project configuration file " + FileName + " not found")
+
+type Config struct {
+	// Dir is the absolute path of the directory containing the configuration
+	// file. Relative paths within the configuration are relative to it.
+	Dir string `json:"-"`
+
+	// Roots are the directories searched for modules.
+	Roots []string `json:"roots"`
+
+	// Excludes are patterns of files and directories to skip when searching
+	// for modules. See cmodule.Walker for how they are matched.
+	Excludes []string `json:"excludes,omitempty"`
+
+	// Extensions are the file extensions searched for modules. If empty the
+	// cmodule defaults are used.
+	Extensions []string `json:"extensions,omitempty"`
+
+	// Macros are additional logging macros to search for.
+	Macros []ctlog.MacroSpec `json:"macros,omitempty"`
+
+	// NoDefaultMacros disables searching for the default CTLOG_* macros.
+	NoDefaultMacros bool `json:"noDefaultMacros,omitempty"`
+
+	// LineConvention is the line the compiler uses for __LINE__ in macro
+	// invocations spanning multiple lines, see ctlog.LineConvention.
+	LineConvention ctlog.LineConvention `json:"lineConvention,omitempty"`
+
+	// Header are the options used when generating the module indices header.
+	Header cmodule.HeaderOptions `json:"header"`
+
+	// Output are the locations of the generated files.
+	Output Output `json:"output"`
+
+	// Cache is the path of the file used to cache the lines found in each
+	// source file, so that unchanged files aren't scanned again. If empty no
+	// cache is used.
+	Cache string `json:"cache,omitempty"`
+
+	// Store is the directory of the dictionary store that dictionaries are
+	// published to and looked up from, see ctlog.Store.
+	Store string `json:"store,omitempty"`
+
+	// DevicePrefix is a regular expression matching the prefix added to each
+	// line of output when several devices share a capture, see
+	// ctlog.Decoder.DevicePrefix.
+	DevicePrefix string `json:"devicePrefix,omitempty"`
+
+	// Reproducible makes the generated files independent of where and when
+	// they were built, see Date and cmodule.Walker.Root.
+	Reproducible bool `json:"reproducible,omitempty"`
+}
+
+type Output struct {
+	// Modules is the path of the modules JSON file.
+	Modules string `json:"modules,omitempty"`
+
+	// Header is the path of the module indices header file.
+	Header string `json:"header,omitempty"`
+
+	// Dictionary is the path of the tokenized logging dictionary file.
+	Dictionary string `json:"dictionary,omitempty"`
+
+	// BuildID is the path of the header defining CTLOG_BUILD_ID. It's kept
+	// separate from the module indices header, which every source file
+	// includes, since the build ID changes whenever any logging line does.
+	BuildID string `json:"buildId,omitempty"`
+}
+
+// Find walks up from dir until it finds a project configuration file and
+// returns its path. ErrNotFound is returned if there isn't one.
+func Find(dir string) (path string, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+
+	for {
+		path = filepath.Join(dir, FileName)
+
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if err == nil && !info.IsDir() {
+			return
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			path = ""
+			err = ErrNotFound
+			return
+		}
+		dir = parent
+	}
+}
+
+// Load loads the project configuration file at path.
+func Load(path string) (c *Config, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	c = new(Config)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		err = fmt.Errorf("error decoding %s: %v", path, err)
+		return
+	}
+	c.Dir = filepath.Dir(path)
+	return
+}
+
+// Open loads the project configuration file at path. If path is empty the file
+// is discovered by walking up from the working directory, and a nil *Config is
+// returned if there isn't one.
+func Open(path string) (c *Config, err error) {
+	if path == "" {
+		var wd string
+		wd, err = os.Getwd()
+		if err != nil {
+			return
+		}
+		path, err = Find(wd)
+		if err == ErrNotFound {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	return Load(path)
+}
+
+// Path resolves p relative to the directory containing the configuration
+// file. Empty and absolute paths are returned unchanged.
+func (c *Config) Path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.Dir, filepath.FromSlash(p))
+}
+
+// SearchPaths returns the configured roots resolved relative to the directory
+// containing the configuration file.
+func (c *Config) SearchPaths() []string {
+	paths := make([]string, len(c.Roots))
+	for i, root := range c.Roots {
+		paths[i] = c.Path(root)
+	}
+	return paths
+}
+
+// Walker returns a cmodule.Walker using the configured extensions and
+// excludes. If the configuration is reproducible module paths are relative to
+// the directory containing the configuration file.
+func (c *Config) Walker() cmodule.Walker {
+	w := cmodule.Walker{
+		Extensions: c.Extensions,
+		Excludes:   c.Excludes,
+	}
+	if c.Reproducible {
+		w.Root = c.Dir
+	}
+	return w
+}
+
+// Extractor returns a ctlog.Extractor using the configured macros. It's an
+// error to disable the default macros without configuring any others, since
+// an Extractor without macros uses the defaults.
+func (c *Config) Extractor() (x ctlog.Extractor, err error) {
+	if !c.NoDefaultMacros {
+		x.Macros = append(x.Macros, ctlog.DefaultMacroSpecs...)
+	}
+	x.Macros = append(x.Macros, c.Macros...)
+	if len(x.Macros) == 0 {
+		err = fmt.Errorf("default macros are disabled but no macros are configured")
+	}
+	return
+}
+
+// SourceDateEpochEnv is the environment variable used to override the date
+// recorded in generated files, see https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Date returns the date to record in generated files. If the SOURCE_DATE_EPOCH
+// environment variable is set its value is used. Otherwise the current time is
+// used, or the Unix epoch if reproducible is true.
+func Date(reproducible bool) (date time.Time, err error) {
+	if s := os.Getenv(SourceDateEpochEnv); s != "" {
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid %s: %v", SourceDateEpochEnv, err)
+			return
+		}
+		date = time.Unix(n, 0).UTC()
+		return
+	}
+
+	if reproducible {
+		date = time.Unix(0, 0).UTC()
+	} else {
+		date = time.Now().UTC()
+	}
+	return
+}
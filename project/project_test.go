@@ -0,0 +1,116 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jlubawy/go-ctlog/ctlog"
+)
+
+func TestFind(t *testing.T) {
+	exp, err := filepath.Abs("testdata/ctlog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"testdata", "testdata/a/b/c"} {
+		path, err := Find(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != exp {
+			t.Errorf("expected %s but got %s", exp, path)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load("testdata/ctlog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != dir {
+		t.Errorf("expected dir %s but got %s", dir, c.Dir)
+	}
+
+	expPaths := []string{
+		filepath.Join(dir, "src"),
+		filepath.Join(dir, "lib"),
+	}
+	if paths := c.SearchPaths(); !reflect.DeepEqual(paths, expPaths) {
+		t.Errorf("expected search paths %q but got %q", expPaths, paths)
+	}
+
+	if p := c.Path(c.Output.Header); p != filepath.Join(dir, "build", "cmodule_indices.h") {
+		t.Errorf("unexpected header path %s", p)
+	}
+
+	if c.Header.Guard != "APP_INDICES_H" || c.Header.Defines["CTLOG_LEVELS_ENABLED"] != "(0x0F)" {
+		t.Errorf("unexpected header options %+v", c.Header)
+	}
+
+	w := c.Walker()
+	if !reflect.DeepEqual(w.Extensions, []string{".c", ".cpp"}) || !reflect.DeepEqual(w.Excludes, []string{"third_party"}) {
+		t.Errorf("unexpected walker %+v", w)
+	}
+
+	x, err := c.Extractor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.Macros) != len(ctlog.DefaultMacroSpecs)+1 {
+		t.Fatalf("expected %d macros but got %d", len(ctlog.DefaultMacroSpecs)+1, len(x.Macros))
+	}
+	expSpec := ctlog.MacroSpec{Name: "APP_LOG", FormatArg: 1, CountArg: 2, Level: ctlog.LevelInfo}
+	if spec := x.Macros[len(x.Macros)-1]; spec != expSpec {
+		t.Errorf("expected %+v but got %+v", expSpec, spec)
+	}
+}
+
+func TestConfigExtractorNoMacros(t *testing.T) {
+	c := Config{NoDefaultMacros: true}
+	if _, err := c.Extractor(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDate(t *testing.T) {
+	defer os.Setenv(SourceDateEpochEnv, os.Getenv(SourceDateEpochEnv))
+
+	os.Setenv(SourceDateEpochEnv, "1530144000")
+	for _, reproducible := range []bool{false, true} {
+		date, err := Date(reproducible)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := time.Date(2018, 6, 28, 0, 0, 0, 0, time.UTC); !date.Equal(exp) {
+			t.Errorf("expected %v but got %v", exp, date)
+		}
+	}
+
+	os.Setenv(SourceDateEpochEnv, "")
+	date, err := Date(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date.Unix() != 0 {
+		t.Errorf("expected the Unix epoch but got %v", date)
+	}
+
+	os.Setenv(SourceDateEpochEnv, "yesterday")
+	if _, err := Date(false); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -1,9 +1,12 @@
 /**
- * Framework for working with C modules. A module is defined as a C source
- * file (*.c) that has a unique filename relative to other source files.
- * For example, 'gpio.c' and 'gpio_mcu_abc.c' are two
+ * Framework for working with C modules. A module is defined as a C or C++
+ * source file (*.c, *.cpp, etc.) that has a unique filename relative to other
+ * source files. For example, 'gpio.c' and 'gpio_mcu_abc.cpp' are two
  * distinct modules with the names 'gpio' and 'gpio_mcu_abc'
- * respectively. See the macros below for how to define and use modules.
+ * respectively. Header files may also define their own module so that code
+ * within them (e.g. static inline functions) can be identified separately from
+ * the source files that include them. See the macros below for how to define
+ * and use modules.
  *
  * Rather than store the name of each module name as a string in the firmware
  * (which uses a lot of code space), we can assign an index to each module
@@ -22,6 +25,10 @@
 
 #include "cmodule_indices.h"
 
+#ifdef __cplusplus
+extern "C" {
+#endif
+
 /*==============================================================================
  *                                   Defines
  *============================================================================*/
@@ -51,6 +58,25 @@
 #define CMODULE_DEFINE( _name ) \
             static cmodule_index_t g_cmodule_index = CMODULE_GET_INDEX( _name )
 
+/*============================================================================*/
+// Helper macro to define a module within a header file. Since a header is
+// included by other modules it can't define 'g_cmodule_index' at file scope,
+// instead this macro must be placed at the top of each function body in the
+// header, where it shadows the including module's index. The cmodule build tool
+// searches header files for this macro as well, the _name argument must be the
+// same everywhere it is used within a header. For example, within the file
+// 'gpio.h' you would write:
+//
+//     static inline void
+//     gpio_set( void )
+//     {
+//         CMODULE_DEFINE_HEADER( gpio_h );
+//         ...
+//     }
+//
+#define CMODULE_DEFINE_HEADER( _name ) \
+            const cmodule_index_t g_cmodule_index = CMODULE_GET_INDEX( _name )
+
 
 /*==============================================================================
  *                                   Types
@@ -73,4 +99,8 @@ typedef uint32_t cmodule_index_t;
 /*============================================================================*/
 
 
+#ifdef __cplusplus
+}
+#endif
+
 #endif /* CMODULE_H */
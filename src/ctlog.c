@@ -9,6 +9,7 @@
 #include <stdbool.h>
 #include <stdint.h>
 #include <stdio.h>
+#include <string.h>
 
 #include "ctlog.h"
 #include "cmodule.h"
@@ -31,6 +32,16 @@ static FILE* g_stream = NULL;
 // one was dropped or is missing.
 static uint16_t g_sequence_number = 0;
 
+/*============================================================================*/
+// Bytes of the binary record being output by ctlog_base64_fprintf that haven't
+// been base64 encoded yet.
+static uint8_t g_base64_bytes[3];
+static int     g_base64_count = 0;
+
+/*============================================================================*/
+static const char g_base64_chars[] =
+    "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
 
 
 /*==============================================================================
@@ -81,6 +92,63 @@ ctlog_fputc_json( char c, FILE* stream )
 }
 
 
+/*============================================================================*/
+// Outputs the base64 characters for the buffered bytes, without padding.
+static void
+ctlog_base64_flush( void )
+{
+    uint32_t bits;
+    int      i;
+
+    if ( g_base64_count == 0 )
+    {
+        return;
+    }
+
+    bits = ((uint32_t)g_base64_bytes[0] << 16);
+    if ( g_base64_count > 1 )
+    {
+        bits |= ((uint32_t)g_base64_bytes[1] << 8);
+    }
+    if ( g_base64_count > 2 )
+    {
+        bits |= (uint32_t)g_base64_bytes[2];
+    }
+
+    for ( i = 0; i <= g_base64_count; i++ )
+    {
+        fputc( g_base64_chars[(bits >> (18 - 6*i)) & 0x3F], g_stream );
+    }
+
+    g_base64_count = 0;
+}
+
+
+/*============================================================================*/
+static void
+ctlog_base64_putByte( uint8_t b )
+{
+    g_base64_bytes[g_base64_count++] = b;
+    if ( g_base64_count == 3 )
+    {
+        ctlog_base64_flush();
+    }
+}
+
+
+/*============================================================================*/
+static void
+ctlog_base64_putUvarint( uint32_t v )
+{
+    while ( v >= 0x80 )
+    {
+        ctlog_base64_putByte( (uint8_t)(v | 0x80) );
+        v >>= 7;
+    }
+    ctlog_base64_putByte( (uint8_t)v );
+}
+
+
 
 /*==============================================================================
  *                               Public Functions
@@ -93,13 +161,28 @@ ctlog_setStream( FILE* stream )
 }
 
 
+/*============================================================================*/
+void
+ctlog_printBuildId( const char* id )
+{
+    if ( g_stream != NULL )
+    {
+        fprintf( g_stream, "ctlog-build-id: %s\n", id );
+    }
+}
+
+
 /*============================================================================*/
 void
 ctlog_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs, ... )
 {
     if ( g_stream != NULL )
     {
-        fprintf( g_stream, "$TL" "%"PRIu16 "," "%"PRIu16 ",%c," "%"PRIu32 "," "%"PRIu32 ",%d,", CTLOG_VERSION, g_sequence_number, level, moduleIndex, line, nArgs );
+        fprintf( g_stream, "$TL" "%02"PRIX16 ",", CTLOG_VERSION );
+#ifdef CTLOG_COMPONENT_ID
+        fprintf( g_stream, "%"PRIu32 ",", (uint32_t)CTLOG_COMPONENT_ID );
+#endif
+        fprintf( g_stream, "%"PRIu16 ",%c," "%"PRIu32 "," "%"PRIu32 ",%d,", g_sequence_number, level, moduleIndex, line, nArgs );
 
         if ( nArgs > 0 )
         {
@@ -150,7 +233,11 @@ ctlog_json_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int
 {
     if ( g_stream != NULL )
     {
-        fprintf( g_stream, "{\"ctlog\":" "%"PRIu16 ",\"seq\":" "%"PRIu16 ",\"lvl\":\"%c\",\"mi\":" "%"PRIu32 ",\"ml\":" "%"PRIu32 ",\"args\":[", CTLOG_VERSION, g_sequence_number, level, moduleIndex, line );
+        fprintf( g_stream, "{\"ctlog\":" "%"PRIu16 ",", CTLOG_VERSION );
+#ifdef CTLOG_COMPONENT_ID
+        fprintf( g_stream, "\"cid\":" "%"PRIu32 ",", (uint32_t)CTLOG_COMPONENT_ID );
+#endif
+        fprintf( g_stream, "\"seq\":" "%"PRIu16 ",\"lvl\":\"%c\",\"mi\":" "%"PRIu32 ",\"ml\":" "%"PRIu32 ",\"args\":[", g_sequence_number, level, moduleIndex, line );
 
         if ( nArgs > 0 )
         {
@@ -221,3 +308,75 @@ ctlog_json_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int
 
     g_sequence_number += 1;
 }
+
+
+/*============================================================================*/
+void
+ctlog_base64_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs, ... )
+{
+    if ( g_stream != NULL )
+    {
+        fputc( CTLOG_BASE64_PREFIX, g_stream );
+
+        ctlog_base64_putByte( (uint8_t)CTLOG_VERSION );
+#ifdef CTLOG_COMPONENT_ID
+        ctlog_base64_putUvarint( (uint32_t)CTLOG_COMPONENT_ID );
+#endif
+        ctlog_base64_putUvarint( g_sequence_number );
+        ctlog_base64_putByte( (uint8_t)level );
+        ctlog_base64_putUvarint( moduleIndex );
+        ctlog_base64_putUvarint( line );
+        ctlog_base64_putUvarint( (uint32_t)nArgs );
+
+        if ( nArgs > 0 )
+        {
+            int i;
+            va_list vl;
+
+            va_start( vl, nArgs );
+            for ( i = 0; i < (2*nArgs); i += 2 )
+            {
+                uint8_t type = (uint8_t)va_arg( vl, int );
+                ctlog_base64_putByte( type );
+
+                switch ( type )
+                {
+                    case CTLOG_TYPE_N_UINT: ctlog_base64_putUvarint( (uint32_t)va_arg( vl, int ) ); break;
+
+                    case CTLOG_TYPE_N_INT:
+                    {
+                        // Zig-zag encode so small negative values stay small
+                        int32_t v = (int32_t)va_arg( vl, int );
+                        uint32_t u = ((uint32_t)v << 1);
+                        ctlog_base64_putUvarint( (v < 0) ? ~u : u );
+                    }
+                    break;
+
+                    case CTLOG_TYPE_N_STRING:
+                    {
+                        const char* s = va_arg( vl, char* );
+                        size_t len = strlen( s );
+                        size_t j;
+
+                        ctlog_base64_putUvarint( (uint32_t)len );
+                        for ( j = 0; j < len; j++ )
+                        {
+                            ctlog_base64_putByte( (uint8_t)s[j] );
+                        }
+                    }
+                    break;
+
+                    case CTLOG_TYPE_N_BOOL: ctlog_base64_putByte( (uint8_t)va_arg( vl, int ) ); break;
+                    case CTLOG_TYPE_N_CHAR: ctlog_base64_putByte( (uint8_t)va_arg( vl, int ) ); break;
+                    default: assert( false ); break;
+                }
+            }
+            va_end( vl );
+        }
+
+        ctlog_base64_flush();
+        fputs( "\n", g_stream );
+    }
+
+    g_sequence_number += 1;
+}
@@ -7,15 +7,27 @@
 
 #include <stdbool.h>
 #include <stdint.h>
+#include <stdio.h>
 
 #include "cmodule.h"
 
+#ifdef __cplusplus
+extern "C" {
+#endif
+
 /*==============================================================================
  *                                   Defines
  *============================================================================*/
 /*============================================================================*/
 // Version tokenized logging lines in case we need to change the output format.
-#define CTLOG_VERSION  ((uint16_t)0x0000)
+// Version 1 adds a component ID so the output of multiple firmware components
+// (e.g. several MCUs sharing a debug UART) can be told apart. Define
+// CTLOG_COMPONENT_ID, for example in the project's header defines, to use it.
+#ifdef CTLOG_COMPONENT_ID
+  #define CTLOG_VERSION  ((uint16_t)0x0001)
+#else
+  #define CTLOG_VERSION  ((uint16_t)0x0000)
+#endif
 
 /*============================================================================*/
 // Logging levels. These definitions must not change or else it will break
@@ -58,6 +70,21 @@
 #define CTLOG_TYPE_STRING( _val )  CTLOG_TYPE_N_STRING, (_val)
 #define CTLOG_TYPE_UINT( _val )    CTLOG_TYPE_N_UINT,   (uint32_t)(_val)
 
+/*============================================================================*/
+// Character that starts a record output by ctlog_base64_fprintf. It must not
+// change or else it will break compatibility with tools that parse tokenized
+// log streams (see ctlog.Base64Prefix).
+#define CTLOG_BASE64_PREFIX  '~'
+
+/*============================================================================*/
+// Function used by the logging macros to output a record. Defaults to the JSON
+// format. Define it as ctlog_base64_fprintf for smaller base64 encoded binary
+// records that can still share a console with text, or as ctlog_fprintf for
+// the $TL format.
+#ifndef CTLOG_FPRINTF
+#define CTLOG_FPRINTF  ctlog_json_fprintf
+#endif
+
 
 
 /*==============================================================================
@@ -66,7 +93,7 @@
 /*============================================================================*/
 // Helper macros for building the log level macros below. Not intended for use
 // outside of this file.
-#define CTLOG_BASE( _level, _nArgs, ... )  (ctlog_json_fprintf( _level, g_cmodule_index, __LINE__, _nArgs, __VA_ARGS__ ))
+#define CTLOG_BASE( _level, _nArgs, ... )  (CTLOG_FPRINTF( _level, g_cmodule_index, __LINE__, _nArgs, __VA_ARGS__ ))
 #define CTLOG_NO_ARGS( _level )            (CTLOG_BASE( _level, 0, NULL ))
 
 /*============================================================================*/
@@ -105,10 +132,20 @@
   #define CTLOG_VAR_WARN( _str, _nArgs, ... )
 #endif
 
+/*============================================================================*/
+// Prints the build ID of the dictionary this program was built with, so that
+// tools can automatically choose the right dictionary to decode its output
+// (e.g. 'ctlog log -store'). CTLOG_BUILD_ID is defined in its own header by
+// 'ctlog build' (e.g. ctlog_build_id.h), which only the source file calling
+// this should include so that a new build ID doesn't recompile everything.
+// This should usually be called once at startup after the stream is set.
+#define CTLOG_PRINT_BUILD_ID()  (ctlog_printBuildId( CTLOG_BUILD_ID ))
+
 /*============================================================================*/
 // When adding/changing new log macros keep in mind that some tools (e.g. tokenlog)
 // use these macro names to create the tokenized log strings file. Make sure to
-// update those tools as necessary.
+// update those tools as necessary (see ctlog.DefaultMacroSpecs). Wrapper macros
+// defined by a project can be passed to 'ctlog dict' using the -macro flag.
 
 
 
@@ -119,6 +156,10 @@
 void
 ctlog_setStream( FILE* stream );
 
+/*============================================================================*/
+void
+ctlog_printBuildId( const char* id );
+
 /*============================================================================*/
 void
 ctlog_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs, ... );
@@ -127,5 +168,13 @@ ctlog_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs
 void
 ctlog_json_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs, ... );
 
+/*============================================================================*/
+void
+ctlog_base64_fprintf( char level, cmodule_index_t moduleIndex, uint32_t line, int nArgs, ... );
+
+
+#ifdef __cplusplus
+}
+#endif
 
 #endif